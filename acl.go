@@ -0,0 +1,176 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"zombiezen.com/go/log"
+)
+
+// accessPolicy is a set of rules that decide
+// which Tailscale identities can access a service.
+type accessPolicy struct {
+	// allow is the list of rules of which at least one must match.
+	// If empty, then any identity not denied is allowed.
+	allow []accessRule
+	// deny is the list of rules of which none may match.
+	deny []accessRule
+}
+
+// Kinds of access rules.
+const (
+	// accessRuleUser matches a user's login name.
+	accessRuleUser = "user"
+	// accessRuleDomain matches the domain of a user's login name.
+	accessRuleDomain = "domain"
+	// accessRuleTag matches a tag on the connecting node.
+	accessRuleTag = "tag"
+	// accessRuleNode matches the connecting node's MagicDNS name.
+	accessRuleNode = "node"
+)
+
+// accessRule matches a Tailscale identity.
+type accessRule struct {
+	kind string
+	// value is the lowercase value to match.
+	// For tag rules, it includes the "tag:" prefix.
+	value string
+}
+
+// parseAccessRule parses a rule of the form "kind:value".
+func parseAccessRule(s string) (accessRule, error) {
+	kind, value, ok := strings.Cut(s, ":")
+	if !ok || value == "" {
+		return accessRule{}, fmt.Errorf("invalid rule %q (must be of the form user:LOGIN, domain:DOMAIN, tag:TAG, or node:NAME)", s)
+	}
+	value = strings.ToLower(value)
+	switch kind {
+	case accessRuleUser, accessRuleDomain:
+	case accessRuleTag:
+		value = "tag:" + strings.TrimPrefix(value, "tag:")
+	case accessRuleNode:
+		value = strings.TrimSuffix(value, ".")
+	case "group":
+		return accessRule{}, fmt.Errorf("invalid rule %q: group rules are not supported because Tailscale WhoIs does not report group membership", s)
+	default:
+		return accessRule{}, fmt.Errorf("invalid rule %q: unknown kind %q", s, kind)
+	}
+	return accessRule{kind: kind, value: value}, nil
+}
+
+func (rule accessRule) String() string {
+	if rule.kind == accessRuleTag {
+		return rule.value
+	}
+	return rule.kind + ":" + rule.value
+}
+
+// matches reports whether the rule matches the given identity.
+func (rule accessRule) matches(whois *apitype.WhoIsResponse) bool {
+	switch rule.kind {
+	case accessRuleUser:
+		return whois.UserProfile != nil && strings.EqualFold(whois.UserProfile.LoginName, rule.value)
+	case accessRuleDomain:
+		if whois.UserProfile == nil {
+			return false
+		}
+		_, domain, ok := strings.Cut(whois.UserProfile.LoginName, "@")
+		return ok && strings.EqualFold(domain, rule.value)
+	case accessRuleTag:
+		return whois.Node != nil && slices.ContainsFunc(whois.Node.Tags, func(tag string) bool {
+			return strings.EqualFold(tag, rule.value)
+		})
+	case accessRuleNode:
+		if whois.Node == nil {
+			return false
+		}
+		// Accept either the full MagicDNS name or its first label.
+		name := strings.TrimSuffix(whois.Node.Name, ".")
+		shortName, _, _ := strings.Cut(name, ".")
+		return strings.EqualFold(name, rule.value) || strings.EqualFold(shortName, rule.value)
+	default:
+		return false
+	}
+}
+
+// errUnidentified is the reason given for denying access
+// to a client whose Tailscale identity could not be determined.
+var errUnidentified = errors.New("could not identify client")
+
+// check returns an error if the policy does not allow the given identity.
+// A nil policy allows any identity.
+func (p *accessPolicy) check(whois *apitype.WhoIsResponse) error {
+	if p == nil {
+		return nil
+	}
+	for _, rule := range p.deny {
+		if rule.matches(whois) {
+			return fmt.Errorf("denied by rule %v", rule)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.allow {
+		if rule.matches(whois) {
+			return nil
+		}
+	}
+	return errors.New("not allowed by any rule")
+}
+
+// describeIdentity returns a human-readable description
+// of a Tailscale identity for error messages.
+func describeIdentity(whois *apitype.WhoIsResponse) string {
+	var parts []string
+	if whois.UserProfile != nil && whois.UserProfile.LoginName != "" {
+		parts = append(parts, "user "+whois.UserProfile.LoginName)
+	}
+	if whois.Node != nil && whois.Node.Name != "" {
+		parts = append(parts, "node "+strings.TrimSuffix(whois.Node.Name, "."))
+	}
+	if len(parts) == 0 {
+		return "unknown identity"
+	}
+	return strings.Join(parts, " on ")
+}
+
+// logAccessDenied logs a request or connection that was rejected
+// by an access policy.
+// The message is a list of key=value pairs
+// so that denials are easy to search for and aggregate.
+// target describes what the client tried to access,
+// like a request line or a listening address.
+// whois may be nil if the client could not be identified.
+func logAccessDenied(ctx context.Context, remoteAddr, target string, whois *apitype.WhoIsResponse, reason error) {
+	var user, node string
+	if whois != nil {
+		if whois.UserProfile != nil {
+			user = whois.UserProfile.LoginName
+		}
+		if whois.Node != nil {
+			node = strings.TrimSuffix(whois.Node.Name, ".")
+		}
+	}
+	log.Infof(ctx, "Access denied: remote=%s target=%q user=%q node=%q reason=%q", remoteAddr, target, user, node, reason.Error())
+}
@@ -0,0 +1,124 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"zombiezen.com/go/ini"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	alice := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		Node:        &tailcfg.Node{Name: "laptop.tail1234.ts.net."},
+	}
+	bob := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.org"},
+		Node:        &tailcfg.Node{Name: "desktop.tail1234.ts.net."},
+	}
+	server := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		Node: &tailcfg.Node{
+			Name: "ci.tail1234.ts.net.",
+			Tags: []string{"tag:ci", "tag:server"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		allowed []*apitype.WhoIsResponse
+		denied  []*apitype.WhoIsResponse
+	}{
+		{
+			name:    "NoRules",
+			input:   "[http 80]\n",
+			allowed: []*apitype.WhoIsResponse{alice, bob, server},
+		},
+		{
+			name:    "User",
+			input:   "[http 80]\nallow = user:Alice@example.com\n",
+			allowed: []*apitype.WhoIsResponse{alice},
+			denied:  []*apitype.WhoIsResponse{bob, server},
+		},
+		{
+			name:    "Domain",
+			input:   "[http 80]\nallow = domain:example.org\n",
+			allowed: []*apitype.WhoIsResponse{bob},
+			denied:  []*apitype.WhoIsResponse{alice, server},
+		},
+		{
+			name:    "Tag",
+			input:   "[http 80]\nallow = tag:server\n",
+			allowed: []*apitype.WhoIsResponse{server},
+			denied:  []*apitype.WhoIsResponse{alice, bob},
+		},
+		{
+			name:    "Node",
+			input:   "[http 80]\nallow = node:laptop, node:desktop.tail1234.ts.net\n",
+			allowed: []*apitype.WhoIsResponse{alice, bob},
+			denied:  []*apitype.WhoIsResponse{server},
+		},
+		{
+			name:    "DenyOnly",
+			input:   "[http 80]\ndeny = tag:ci\n",
+			allowed: []*apitype.WhoIsResponse{alice, bob},
+			denied:  []*apitype.WhoIsResponse{server},
+		},
+		{
+			name: "DenyOverridesAllow",
+			input: "[http 80]\n" +
+				"allow = domain:example.com\n" +
+				"allow = tag:server\n" +
+				"deny = node:laptop\n",
+			allowed: []*apitype.WhoIsResponse{server},
+			denied:  []*apitype.WhoIsResponse{alice, bob},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ini.Parse(strings.NewReader(test.input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := parseAccessPolicy(f, "http 80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, whois := range test.allowed {
+				if err := p.check(whois); err != nil {
+					t.Errorf("check(%s) = %v; want <nil>", describeIdentity(whois), err)
+				}
+			}
+			for _, whois := range test.denied {
+				if err := p.check(whois); err == nil {
+					t.Errorf("check(%s) = <nil>; want error", describeIdentity(whois))
+				}
+			}
+		})
+	}
+
+	for _, bad := range []string{"alice@example.com", "group:admins", "user:"} {
+		if _, err := parseAccessRule(bad); err == nil {
+			t.Errorf("parseAccessRule(%q) did not return an error", bad)
+		}
+	}
+}
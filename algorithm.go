@@ -0,0 +1,315 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// A balancingAlgorithm chooses which endpoint receives the next connection.
+type balancingAlgorithm interface {
+	// choose returns the index of the chosen element of candidates.
+	// candidates is never empty and is given in round-robin order,
+	// so algorithms should prefer earlier candidates to break ties.
+	// choose is called while holding the load balancer's lock.
+	choose(candidates []candidate, opts *pickOptions) int
+}
+
+// candidate is an endpoint that is eligible to be picked.
+type candidate struct {
+	*endpoint
+	// index is the endpoint's position in the load balancer's queue.
+	index int
+	// weight is the endpoint's effective weight. It is always positive.
+	weight float64
+	// active is the number of in-flight uses of the endpoint's address.
+	active int
+}
+
+// balancingAlgorithms is the set of algorithms
+// that can be used in the "algorithm" configuration setting.
+var balancingAlgorithms = map[string]func() balancingAlgorithm{
+	"round-robin": func() balancingAlgorithm { return roundRobin{} },
+	"least-conn":  func() balancingAlgorithm { return leastConn{} },
+	"hash":        func() balancingAlgorithm { return hashing{} },
+	"random":      func() balancingAlgorithm { return randomChoice{} },
+	"p2c":         func() balancingAlgorithm { return powerOfTwoChoices{} },
+	"ewma":        func() balancingAlgorithm { return ewma{} },
+}
+
+const defaultBalancingAlgorithm = "round-robin"
+
+// roundRobin is a [balancingAlgorithm] that uses
+// the smooth weighted round-robin algorithm from nginx.
+type roundRobin struct{}
+
+func (roundRobin) choose(candidates []candidate, opts *pickOptions) int {
+	total := 0.0
+	best := 0
+	for i, c := range candidates {
+		c.current += c.weight
+		total += c.weight
+		if c.current > candidates[best].current {
+			best = i
+		}
+	}
+	candidates[best].current -= total
+	return best
+}
+
+// leastConn is a [balancingAlgorithm] that chooses the endpoint
+// with the fewest in-flight connections relative to its weight.
+type leastConn struct{}
+
+func (leastConn) choose(candidates []candidate, opts *pickOptions) int {
+	best := 0
+	for i, c := range candidates[1:] {
+		b := candidates[best]
+		// c.active/c.weight < b.active/b.weight
+		if float64(c.active)*b.weight < float64(b.active)*c.weight {
+			best = i + 1
+		}
+	}
+	return best
+}
+
+// randomChoice is a [balancingAlgorithm] that chooses an endpoint at random
+// with probability proportional to its weight.
+type randomChoice struct {
+	// rand is the source of randomness.
+	// If nil, then the global source is used.
+	rand *rand.Rand
+}
+
+func (alg randomChoice) choose(candidates []candidate, opts *pickOptions) int {
+	total := 0.0
+	for _, c := range candidates {
+		total += c.weight
+	}
+	x := randFloat64(alg.rand) * total
+	for i, c := range candidates {
+		if x < c.weight {
+			return i
+		}
+		x -= c.weight
+	}
+	// Floating point rounding can leave x just above the last weight.
+	return len(candidates) - 1
+}
+
+// powerOfTwoChoices is a [balancingAlgorithm] that picks two endpoints at random
+// and chooses the one with fewer in-flight connections relative to its weight.
+// Unlike [leastConn], independent load balancers using the same backends
+// won't all choose the same endpoint at the same time.
+type powerOfTwoChoices struct {
+	// rand is the source of randomness.
+	// If nil, then the global source is used.
+	rand *rand.Rand
+}
+
+func (alg powerOfTwoChoices) choose(candidates []candidate, opts *pickOptions) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	i := randIntN(alg.rand, len(candidates))
+	j := randIntN(alg.rand, len(candidates)-1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	// b.active/b.weight < a.active/a.weight
+	if float64(b.active)*a.weight < float64(a.active)*b.weight {
+		return j
+	}
+	return i
+}
+
+func randIntN(r *rand.Rand, n int) int {
+	if r == nil {
+		return rand.IntN(n)
+	}
+	return r.IntN(n)
+}
+
+func randFloat64(r *rand.Rand) float64 {
+	if r == nil {
+		return rand.Float64()
+	}
+	return r.Float64()
+}
+
+// ewma is a [balancingAlgorithm] that chooses the endpoint
+// with the lowest expected latency,
+// estimated as the endpoint's decayed average response time
+// multiplied by its in-flight requests (plus one), divided by its weight.
+// Response times are recorded with [*loadBalancer.observeLatency].
+// If none of the candidates have been observed, ewma falls back to [roundRobin].
+// Otherwise, candidates without observations are assumed
+// to have the average latency of the observed candidates.
+type ewma struct{}
+
+// ewmaDecay is the time constant for decaying observed latencies.
+// An observation's influence drops to 1/e after this much time.
+const ewmaDecay = 10 * time.Second
+
+// ewmaErrorPenalty is the minimum latency recorded
+// for a request that fails without a response from the backend,
+// so that failing backends don't appear faster than working ones.
+const ewmaErrorPenalty = 10 * time.Second
+
+func (ewma) choose(candidates []candidate, opts *pickOptions) int {
+	sum := 0.0
+	observed := 0
+	for _, c := range candidates {
+		if c.latency > 0 {
+			sum += c.latency
+			observed++
+		}
+	}
+	if observed == 0 {
+		return roundRobin{}.choose(candidates, opts)
+	}
+	defaultLatency := sum / float64(observed)
+
+	best := 0
+	bestCost := 0.0
+	for i, c := range candidates {
+		latency := c.latency
+		if latency <= 0 {
+			latency = defaultLatency
+		}
+		cost := latency * float64(c.active+1) / c.weight
+		if i == 0 || cost < bestCost {
+			best = i
+			bestCost = cost
+		}
+	}
+	return best
+}
+
+// observe updates the endpoint's latency estimate with a response time.
+// Latencies higher than the current estimate replace it immediately,
+// so that the estimate reacts quickly to a slow endpoint.
+func (e *endpoint) observe(now time.Time, d time.Duration) {
+	x := max(d.Seconds(), 1e-9)
+	if e.latency == 0 || x > e.latency {
+		e.latency = x
+	} else {
+		w := math.Exp(-now.Sub(e.latencyTime).Seconds() / ewmaDecay.Seconds())
+		e.latency = e.latency*w + x*(1-w)
+	}
+	e.latencyTime = now
+}
+
+// hashing is a [balancingAlgorithm] that consistently chooses
+// the same endpoint for the same [pickOptions] hashKey
+// using weighted rendezvous hashing.
+// When an endpoint becomes available or unavailable,
+// only the keys that map to that endpoint move.
+// If the hashKey is empty, then hashing chooses the first candidate.
+type hashing struct{}
+
+func (hashing) choose(candidates []candidate, opts *pickOptions) int {
+	if opts.hashKey == "" {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(opts.hashKey))
+	keyHash := h.Sum64()
+
+	best := 0
+	bestScore := 0.0
+	for i, c := range candidates {
+		score := rendezvousScore(keyHash, c.addr, c.weight)
+		if i == 0 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// rendezvousScore returns the score of an endpoint for a key.
+// The endpoint with the highest score for a key is chosen.
+// The scores are distributed such that the probability of an endpoint
+// having the highest score is proportional to its weight.
+func rendezvousScore(keyHash uint64, addr netip.AddrPort, weight float64) float64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], keyHash)
+	h.Write(buf[:])
+	addrBytes, _ := addr.MarshalBinary()
+	h.Write(addrBytes)
+	// Map the hash to a uniform value in the open interval (0, 1).
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// mix64 is the finalizer from SplitMix64.
+// It spreads small differences in FNV's input across all of the output bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hashKeySource is the client attribute used as the key
+// for the "hash" algorithm.
+type hashKeySource string
+
+const (
+	hashKeyClientIP hashKeySource = "client-ip"
+	hashKeyNode     hashKeySource = "node"
+	hashKeyUser     hashKeySource = "user"
+)
+
+const defaultHashKeySource = hashKeyClientIP
+
+// needsWhoIs reports whether the key requires a Tailscale WhoIs lookup.
+func (src hashKeySource) needsWhoIs() bool {
+	return src == hashKeyNode || src == hashKeyUser
+}
+
+// key returns the hash key for a client.
+// whois is only called if src.needsWhoIs() is true.
+// If whois returns nil, then the client's IP address is used as the key.
+func (src hashKeySource) key(remoteAddr string, whois func() *apitype.WhoIsResponse) string {
+	switch src {
+	case hashKeyNode:
+		if w := whois(); w != nil && w.Node != nil {
+			return "node:" + string(w.Node.StableID)
+		}
+	case hashKeyUser:
+		if w := whois(); w != nil && w.UserProfile != nil {
+			return "user:" + w.UserProfile.LoginName
+		}
+	}
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return "ip:" + addrPort.Addr().Unmap().String()
+	}
+	return "ip:" + remoteAddr
+}
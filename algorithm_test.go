@@ -0,0 +1,270 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"zombiezen.com/go/log/testlog"
+)
+
+func TestLeastConn(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	addr1 := netip.MustParseAddrPort("192.0.2.1:80")
+	addr2 := netip.MustParseAddrPort("192.0.2.2:80")
+	addr3 := netip.MustParseAddrPort("192.0.2.3:80")
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: addr1.Addr(), port: 80},
+		{addr: addr2.Addr(), port: 80},
+		{addr: addr3.Addr(), port: 80, weight: 2},
+	})
+	lb.algorithm = leastConn{}
+
+	pick := func() netip.AddrPort {
+		t.Helper()
+		addr, err := lb.pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	// addr3 has twice the weight, so it should receive two connections
+	// for every one of the other addresses.
+	got := make(map[netip.AddrPort]int)
+	for i := 0; i < 4; i++ {
+		got[pick()]++
+	}
+	want := map[netip.AddrPort]int{addr1: 1, addr2: 1, addr3: 2}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("pick counts (-want +got):\n%s", diff)
+	}
+
+	// Once a connection finishes, its address should be preferred.
+	lb.release(ctx, addr2)
+	if got := pick(); got != addr2 {
+		t.Errorf("pick after releasing %v = %v; want %v", addr2, got, addr2)
+	}
+	lb.release(ctx, addr3)
+	lb.release(ctx, addr3)
+	if got := pick(); got != addr3 {
+		t.Errorf("pick after releasing %v = %v; want %v", addr3, got, addr3)
+	}
+}
+
+func TestHashing(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	addrs := []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:80"),
+		netip.MustParseAddrPort("192.0.2.2:80"),
+		netip.MustParseAddrPort("192.0.2.3:80"),
+		netip.MustParseAddrPort("192.0.2.4:80"),
+	}
+	var backends []*backend
+	for _, addr := range addrs {
+		backends = append(backends, &backend{addr: addr.Addr(), port: addr.Port(), weight: 1})
+	}
+	lb := newLoadBalancer(fakeResolver{}, backends)
+	lb.algorithm = hashing{}
+
+	const numKeys = 1000
+	pickAll := func() map[string]netip.AddrPort {
+		t.Helper()
+		m := make(map[string]netip.AddrPort)
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("user:%d@example.com", i)
+			addr, err := lb.pickWithOptions(ctx, &pickOptions{hashKey: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb.release(ctx, addr)
+			m[key] = addr
+		}
+		return m
+	}
+
+	before := pickAll()
+	for key, addr := range pickAll() {
+		if prev := before[key]; addr != prev {
+			t.Errorf("key %q picked %v then %v", key, prev, addr)
+		}
+	}
+	counts := make(map[netip.AddrPort]int)
+	for _, addr := range before {
+		counts[addr]++
+	}
+	for _, addr := range addrs {
+		// Expect 250 per address.
+		if n := counts[addr]; n < 150 || n > 350 {
+			t.Errorf("%v picked for %d/%d keys; want about %d", addr, n, numKeys, numKeys/len(addrs))
+		}
+	}
+
+	// Taking an address out of rotation should only move its keys.
+	down := addrs[1]
+	lb.setHealthy(down, false)
+	after := pickAll()
+	for key, addr := range after {
+		if prev := before[key]; prev != down && addr != prev {
+			t.Errorf("key %q moved from %v to %v after %v went down", key, prev, addr, down)
+		}
+		if addr == down {
+			t.Errorf("key %q picked unhealthy address %v", key, down)
+		}
+	}
+}
+
+func TestHashKeySource(t *testing.T) {
+	whois := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{StableID: "nABC123"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+	}
+	tests := []struct {
+		src   hashKeySource
+		whois *apitype.WhoIsResponse
+		want  string
+	}{
+		{src: hashKeyClientIP, whois: whois, want: "ip:100.64.0.1"},
+		{src: hashKeyNode, whois: whois, want: "node:nABC123"},
+		{src: hashKeyUser, whois: whois, want: "user:alice@example.com"},
+		{src: hashKeyNode, whois: nil, want: "ip:100.64.0.1"},
+		{src: hashKeyUser, whois: nil, want: "ip:100.64.0.1"},
+	}
+	for _, test := range tests {
+		got := test.src.key("100.64.0.1:43210", func() *apitype.WhoIsResponse { return test.whois })
+		if got != test.want {
+			t.Errorf("hashKeySource(%q).key(...) [whois=%t] = %q; want %q", test.src, test.whois != nil, got, test.want)
+		}
+	}
+}
+
+func TestRandomChoice(t *testing.T) {
+	alg := randomChoice{rand: rand.New(rand.NewPCG(1, 2))}
+	candidates := []candidate{
+		{endpoint: new(endpoint), weight: 1},
+		{endpoint: new(endpoint), weight: 3},
+	}
+	const n = 4000
+	var counts [2]int
+	for i := 0; i < n; i++ {
+		counts[alg.choose(candidates, new(pickOptions))]++
+	}
+	// Expect 1000 and 3000.
+	if counts[0] < 800 || counts[0] > 1200 {
+		t.Errorf("weight 1 candidate chosen %d/%d times; want about %d", counts[0], n, n/4)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	alg := powerOfTwoChoices{rand: rand.New(rand.NewPCG(1, 2))}
+	candidates := []candidate{
+		{endpoint: new(endpoint), weight: 1, active: 0},
+		{endpoint: new(endpoint), weight: 1, active: 5},
+		{endpoint: new(endpoint), weight: 2, active: 1},
+	}
+	var counts [3]int
+	for i := 0; i < 100; i++ {
+		counts[alg.choose(candidates, new(pickOptions))]++
+	}
+	// Any two candidates include one that is less loaded than candidate 1.
+	if counts[1] > 0 {
+		t.Errorf("busiest candidate chosen %d times; want 0", counts[1])
+	}
+	if counts[0] == 0 || counts[2] == 0 {
+		t.Errorf("counts = %v; want candidates 0 and 2 to be chosen", counts)
+	}
+
+	if got := alg.choose(candidates[1:2], new(pickOptions)); got != 0 {
+		t.Errorf("choose with single candidate = %d; want 0", got)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	fast := netip.MustParseAddrPort("192.0.2.1:80")
+	slow := netip.MustParseAddrPort("192.0.2.2:80")
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: fast.Addr(), port: fast.Port(), weight: 1},
+		{addr: slow.Addr(), port: slow.Port(), weight: 1},
+	})
+	lb.algorithm = ewma{}
+
+	// Without any observations, addresses are picked round-robin.
+	got := make(map[netip.AddrPort]int)
+	for i := 0; i < 4; i++ {
+		addr, err := lb.pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb.release(ctx, addr)
+		got[addr]++
+	}
+	if got[fast] != 2 || got[slow] != 2 {
+		t.Errorf("pick counts without observations = %v; want 2 each", got)
+	}
+
+	lb.observeLatency(fast, 10*time.Millisecond)
+	lb.observeLatency(slow, 100*time.Millisecond)
+	for i := 0; i < 9; i++ {
+		addr, err := lb.pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != fast {
+			t.Errorf("pick #%d = %v; want %v", i+1, addr, fast)
+		}
+	}
+	// With 10 requests in flight, the fast address is as costly as the slow one,
+	// so the next two picks should go to one of each.
+	got = make(map[netip.AddrPort]int)
+	for i := 0; i < 2; i++ {
+		addr, err := lb.pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[addr]++
+	}
+	if got[fast] != 1 || got[slow] != 1 {
+		t.Errorf("pick counts with fast address loaded = %v; want 1 each", got)
+	}
+}
+
+func TestEndpointObserve(t *testing.T) {
+	start := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	e := new(endpoint)
+	e.observe(start, 100*time.Millisecond)
+	if e.latency != 0.1 {
+		t.Errorf("after first observation, latency = %g; want 0.1", e.latency)
+	}
+	e.observe(start.Add(ewmaDecay), 0)
+	if e.latency < 0.03 || e.latency > 0.04 {
+		// 0.1/e ≈ 0.0368
+		t.Errorf("after fast observation, latency = %g; want about 0.037", e.latency)
+	}
+	e.observe(start.Add(ewmaDecay+time.Second), time.Second)
+	if e.latency != 1 {
+		t.Errorf("after slow observation, latency = %g; want 1", e.latency)
+	}
+}
@@ -17,16 +17,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
+	"net/http"
 	"net/netip"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
-	"unicode/utf8"
 
+	"tailscale.com/tailcfg"
 	"zombiezen.com/go/ini"
 	"zombiezen.com/go/log"
 )
@@ -37,28 +45,236 @@ type configuration struct {
 	controlURL string
 	stateDir   string
 	ports      map[uint16]portConfig
+	// udpPorts is the set of UDP ports to listen on.
+	// UDP ports are separate from the TCP ports in ports.
+	udpPorts map[uint16]*udpConfig
 }
 
 type portConfig struct {
 	tcp  *tcpConfig
 	http *httpConfig
+	tls  *tlsConfig
 }
 
 func (pc portConfig) isEmpty() bool {
-	return pc.tcp == nil && pc.http == nil
+	return pc.tcp == nil && pc.http == nil && pc.tls == nil
 }
 
 type tcpConfig struct {
-	backends []*backend
+	poolConfig
+	retries        int
+	connectTimeout time.Duration
+	proxyProtocol  int
+	// tls is whether to terminate TLS on incoming connections.
+	tls bool
+	// alpn is the list of protocols to offer during TLS negotiation.
+	alpn []string
+	// access restricts which Tailscale identities can connect.
+	// If nil, then any identity is allowed.
+	access *accessPolicy
 }
 
 type httpConfig struct {
-	backends []*backend
+	httpBackendConfig
 	whois    bool
 	trustXFF bool
 	tls      bool
+	// readHeaderTimeout is the maximum time to read a request's headers.
+	readHeaderTimeout time.Duration
+	// idleTimeout is how long to keep an idle client connection open
+	// between requests.
+	idleTimeout time.Duration
+	// streamTimeout is the maximum time for a single request,
+	// including reading its body and writing its response.
+	// Upgraded connections (like WebSockets) are exempt.
+	// If zero, then requests have no time limit.
+	streamTimeout time.Duration
+	// appCapabilities is the list of Tailscale application capabilities
+	// to forward to backends.
+	appCapabilities []tailcfg.PeerCapability
+	// access restricts which Tailscale identities can make requests
+	// on the port, including requests that match a route.
+	// If nil, then any identity is allowed.
+	access *accessPolicy
+	// routes maps route names to rules that send matching requests
+	// to their own backends.
+	// Requests that don't match any route use the section's backends.
+	routes map[string]*httpRouteConfig
 }
 
+// httpBackendConfig is the configuration for forwarding HTTP requests
+// to a pool of backends.
+type httpBackendConfig struct {
+	poolConfig
+	// stickyCookie is the name of the cookie used for sticky sessions.
+	// If empty, then sticky sessions are disabled.
+	stickyCookie string
+	// stickyKey is the key used to sign sticky session cookies.
+	// If nil, then a random key is generated at startup.
+	stickyKey []byte
+	// backendTLS is the configuration for connecting to backends over HTTPS.
+	// If nil, then backends are sent plain HTTP.
+	backendTLS *tls.Config
+	// backendProtocol is the HTTP version used to talk to backends.
+	// It is one of backendProtocolH1, backendProtocolH2, or backendProtocolH2C.
+	backendProtocol string
+}
+
+// httpRouteConfig is a rule in an http section.
+// A request matches if it satisfies all of the rule's conditions.
+type httpRouteConfig struct {
+	httpBackendConfig
+	// host is a lowercase host name to match.
+	// A name that starts with "*." matches any single label in its place.
+	// If empty, then any host matches.
+	host string
+	// pathPrefix is a path that must be equal to the request path
+	// or a parent of it.
+	// If empty, then any path matches.
+	pathPrefix string
+	// pathRegexp is matched against the request path.
+	// If nil, then any path matches.
+	pathRegexp *regexp.Regexp
+	// methods is the set of request methods to match.
+	// If empty, then any method matches.
+	methods []string
+	// headers is a list of request header fields
+	// that must be present with the given values.
+	headers []httpHeaderMatch
+	// rewritePathPrefix replaces pathPrefix in forwarded requests
+	// if rewritePath is true.
+	rewritePathPrefix string
+	rewritePath       bool
+	// access restricts which Tailscale identities can use the route
+	// in addition to the section's policy.
+	// If nil, then the section's policy applies alone.
+	access *accessPolicy
+}
+
+// httpHeaderMatch is a condition that a request must have
+// a header field with the given value.
+type httpHeaderMatch struct {
+	// name is the canonical header field name.
+	name string
+	// value is the exact value to match.
+	// If empty, then the header only needs to be present.
+	value string
+}
+
+// tlsConfig is the configuration for a port that forwards TLS connections
+// to backends chosen by the server name in the TLS ClientHello.
+type tlsConfig struct {
+	// defaultRoute is used for connections that don't match any route.
+	// If nil, then such connections are closed.
+	defaultRoute *tcpConfig
+	// routes maps lowercase server names to their configuration.
+	// A name that starts with "*." matches any single label in its place.
+	routes map[string]*tcpConfig
+	// access restricts which Tailscale identities can connect to the port,
+	// including connections that match a route.
+	// If nil, then any identity is allowed.
+	access *accessPolicy
+}
+
+type udpConfig struct {
+	poolConfig
+	idleTimeout time.Duration
+	maxFlows    int
+}
+
+// poolConfig is the configuration for a set of backends
+// that are load balanced together.
+type poolConfig struct {
+	backends         []*backend
+	algorithm        string        // key in balancingAlgorithms
+	hashKey          hashKeySource // empty unless algorithm is "hash"
+	slowStart        time.Duration // zero if disabled
+	minDNSTTL        time.Duration
+	maxDNSTTL        time.Duration
+	healthCheck      *healthCheckConfig
+	outlierDetection *outlierDetectionConfig
+}
+
+// healthCheckConfig is the configuration for active health checks.
+type healthCheckConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+	// rise is the number of consecutive successful checks
+	// required for an unhealthy address to be considered healthy.
+	rise int
+	// fall is the number of consecutive failed checks
+	// required for a healthy address to be considered unhealthy.
+	fall int
+	// http is non-nil if checks should make HTTP requests
+	// instead of only establishing a TCP connection.
+	http *httpHealthCheckConfig
+}
+
+// httpHealthCheckConfig is the configuration for HTTP health checks.
+type httpHealthCheckConfig struct {
+	method string
+	// path is the request target, including any query string.
+	path string
+	// host is the Host header to send.
+	// If empty, the backend's address is used.
+	host      string
+	minStatus int
+	maxStatus int
+	// body is a substring that must be present in the response body.
+	// If empty, the response body is not checked.
+	body string
+	// tls is the configuration for checking over HTTPS.
+	// If nil, then checks use plain HTTP.
+	tls *tls.Config
+	// protocol is the HTTP version used for checks.
+	protocol string
+}
+
+// outlierDetectionConfig is the configuration for passive health checks,
+// which eject addresses based on failures observed in regular traffic.
+type outlierDetectionConfig struct {
+	// consecutiveFailures is the number of consecutive failures
+	// that cause an address to be ejected.
+	consecutiveFailures int
+	// baseEjectionTime is the duration of an address's first ejection.
+	// Each subsequent ejection doubles the duration.
+	baseEjectionTime time.Duration
+	maxEjectionTime  time.Duration
+	// maxEjectionPercent is the maximum percentage of addresses
+	// that can be ejected at once.
+	maxEjectionPercent int
+}
+
+const defaultConnectTimeout = 30 * time.Second
+
+const defaultUDPIdleTimeout = 1 * time.Minute
+
+const defaultUDPMaxFlows = 4096
+
+const (
+	defaultHTTPReadHeaderTimeout = 5 * time.Second
+	defaultHTTPIdleTimeout       = 2 * time.Minute
+)
+
+const (
+	defaultMinDNSTTL = 5 * time.Second
+	defaultMaxDNSTTL = 5 * time.Minute
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+const (
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierBaseEjectionTime    = 30 * time.Second
+	defaultOutlierMaxEjectionTime     = 5 * time.Minute
+	defaultOutlierMaxEjectionPercent  = 50
+)
+
 func (cfg *configuration) fill(source configer) error {
 	if cfg.hostname == "" {
 		cfg.hostname = source.Get("", "hostname")
@@ -99,18 +315,69 @@ func (cfg *configuration) fill(source configer) error {
 			} else if !cfg.ports[portNumber].isEmpty() {
 				return fmt.Errorf("read config: conflicting definition of port %d", portNumber)
 			}
-			tc := new(tcpConfig)
+			tc, err := parseTCPConfig(source, sectionName, portNumber)
+			if err != nil {
+				return fmt.Errorf("read config: tcp %d: %v", portNumber, err)
+			}
+			if s := source.Get(sectionName, "tls"); s != "" {
+				tc.tls, err = strconv.ParseBool(s)
+				if err != nil {
+					return fmt.Errorf("read config: tcp %d: tls: %v", portNumber, err)
+				}
+			}
+			if tc.tls {
+				for _, proto := range strings.Split(source.Get(sectionName, "alpn"), ",") {
+					if proto = strings.TrimSpace(proto); proto != "" {
+						tc.alpn = append(tc.alpn, proto)
+					}
+				}
+			}
 			cfg.ports[portNumber] = portConfig{tcp: tc}
+		case strings.HasPrefix(sectionName, "tls "):
+			portString, serverName, hasServerName := strings.Cut(sectionName[len("tls "):], " ")
+			n, err := strconv.ParseUint(portString, 10, 16)
+			if err != nil {
+				log.Warnf(context.TODO(), "Unknown config section %q", sectionName)
+				continue
+			}
+			portNumber := uint16(n)
+			if portNumber == 0 {
+				return fmt.Errorf("read config: cannot configure port 0")
+			}
+			if cfg.ports == nil {
+				cfg.ports = make(map[uint16]portConfig)
+			}
+			pc := cfg.ports[portNumber]
+			if pc.tls == nil {
+				if !pc.isEmpty() {
+					return fmt.Errorf("read config: conflicting definition of port %d", portNumber)
+				}
+				pc.tls = &tlsConfig{routes: make(map[string]*tcpConfig)}
+				cfg.ports[portNumber] = pc
+			}
 
-			for _, backendAddr := range source.Find(sectionName, "backend") {
-				b, err := parseBackend(backendAddr, portNumber)
-				if err != nil {
-					return fmt.Errorf("read config: tcp %d: %v", portNumber, err)
+			tc, err := parseTCPConfig(source, sectionName, portNumber)
+			if err != nil {
+				return fmt.Errorf("read config: %s: %v", sectionName, err)
+			}
+			if !hasServerName {
+				pc.tls.access = tc.access
+				if len(tc.backends) > 0 {
+					pc.tls.defaultRoute = tc
 				}
-				tc.backends = append(tc.backends, b)
+				continue
+			}
+			serverName = strings.ToLower(strings.TrimSpace(serverName))
+			if !isServerNamePattern(serverName) {
+				return fmt.Errorf("read config: %s: invalid server name %q", sectionName, serverName)
 			}
+			if pc.tls.routes[serverName] != nil {
+				return fmt.Errorf("read config: %s: conflicting definition of server name %q", sectionName, serverName)
+			}
+			pc.tls.routes[serverName] = tc
 		case strings.HasPrefix(sectionName, "http "):
-			n, err := strconv.ParseUint(sectionName[len("http "):], 10, 16)
+			portString, routeName, hasRouteName := strings.Cut(sectionName[len("http "):], " ")
+			n, err := strconv.ParseUint(portString, 10, 16)
 			if err != nil {
 				log.Warnf(context.TODO(), "Unknown config section %q", sectionName)
 				continue
@@ -121,11 +388,34 @@ func (cfg *configuration) fill(source configer) error {
 			}
 			if cfg.ports == nil {
 				cfg.ports = make(map[uint16]portConfig)
-			} else if !cfg.ports[portNumber].isEmpty() {
-				return fmt.Errorf("read config: conflicting definition of port %d", portNumber)
 			}
-			hc := new(httpConfig)
-			cfg.ports[portNumber] = portConfig{http: hc}
+			pc := cfg.ports[portNumber]
+			if pc.http == nil {
+				if !pc.isEmpty() {
+					return fmt.Errorf("read config: conflicting definition of port %d", portNumber)
+				}
+				pc.http = &httpConfig{
+					whois:             true,
+					readHeaderTimeout: defaultHTTPReadHeaderTimeout,
+					idleTimeout:       defaultHTTPIdleTimeout,
+					routes:            make(map[string]*httpRouteConfig),
+				}
+				cfg.ports[portNumber] = pc
+			}
+			hc := pc.http
+
+			if hasRouteName {
+				routeName = strings.TrimSpace(routeName)
+				if !isToken(routeName) {
+					return fmt.Errorf("read config: %s: invalid route name %q", sectionName, routeName)
+				}
+				rc, err := parseHTTPRouteConfig(source, sectionName, portNumber, routeName)
+				if err != nil {
+					return fmt.Errorf("read config: %s: %v", sectionName, err)
+				}
+				hc.routes[routeName] = rc
+				continue
+			}
 
 			if s := source.Get(sectionName, "tls"); s != "" {
 				var err error
@@ -148,12 +438,74 @@ func (cfg *configuration) fill(source configer) error {
 					return fmt.Errorf("read config: http %d: trust-x-forwarded-for: %v", portNumber, err)
 				}
 			}
-			for _, backendAddr := range source.Find(sectionName, "backend") {
-				b, err := parseBackend(backendAddr, portNumber)
-				if err != nil {
-					return fmt.Errorf("read config: http %d: %v", portNumber, err)
+			hc.readHeaderTimeout, err = parsePositiveDuration(source, sectionName, "read-header-timeout", defaultHTTPReadHeaderTimeout)
+			if err != nil {
+				return fmt.Errorf("read config: http %d: %v", portNumber, err)
+			}
+			hc.idleTimeout, err = parsePositiveDuration(source, sectionName, "idle-timeout", defaultHTTPIdleTimeout)
+			if err != nil {
+				return fmt.Errorf("read config: http %d: %v", portNumber, err)
+			}
+			hc.streamTimeout, err = parsePositiveDuration(source, sectionName, "stream-timeout", 0)
+			if err != nil {
+				return fmt.Errorf("read config: http %d: %v", portNumber, err)
+			}
+			hc.access, err = parseAccessPolicy(source, sectionName)
+			if err != nil {
+				return fmt.Errorf("read config: http %d: %v", portNumber, err)
+			}
+			for _, line := range source.Find(sectionName, "app-capabilities") {
+				for _, name := range strings.Split(line, ",") {
+					name = strings.TrimSpace(name)
+					if name == "" {
+						continue
+					}
+					if strings.ContainsFunc(name, unicode.IsSpace) {
+						return fmt.Errorf("read config: http %d: app-capabilities: invalid capability name %q", portNumber, name)
+					}
+					hc.appCapabilities = append(hc.appCapabilities, tailcfg.PeerCapability(name))
 				}
-				hc.backends = append(hc.backends, b)
+			}
+			bc, err := parseHTTPBackendConfig(source, sectionName, portNumber, defaultStickyCookieName)
+			if err != nil {
+				return fmt.Errorf("read config: http %d: %v", portNumber, err)
+			}
+			hc.httpBackendConfig = *bc
+		case strings.HasPrefix(sectionName, "udp "):
+			n, err := strconv.ParseUint(sectionName[len("udp "):], 10, 16)
+			if err != nil {
+				log.Warnf(context.TODO(), "Unknown config section %q", sectionName)
+				continue
+			}
+			portNumber := uint16(n)
+			if portNumber == 0 {
+				return fmt.Errorf("read config: cannot configure port 0")
+			}
+			if cfg.udpPorts == nil {
+				cfg.udpPorts = make(map[uint16]*udpConfig)
+			} else if cfg.udpPorts[portNumber] != nil {
+				return fmt.Errorf("read config: conflicting definition of udp port %d", portNumber)
+			}
+			uc := new(udpConfig)
+			cfg.udpPorts[portNumber] = uc
+
+			uc.poolConfig, err = parsePoolConfig(source, sectionName, portNumber)
+			if err != nil {
+				return fmt.Errorf("read config: udp %d: %v", portNumber, err)
+			}
+			if uc.algorithm == "ewma" {
+				return fmt.Errorf("read config: udp %d: algorithm: ewma is only supported in http sections", portNumber)
+			}
+			if uc.healthCheck != nil {
+				return fmt.Errorf("read config: udp %d: health-check: not supported in udp sections", portNumber)
+			}
+			uc.idleTimeout, err = parsePositiveDuration(source, sectionName, "idle-timeout", defaultUDPIdleTimeout)
+			if err != nil {
+				return fmt.Errorf("read config: udp %d: %v", portNumber, err)
+			}
+			uc.maxFlows, err = parsePositiveInt(source, sectionName, "max-flows", defaultUDPMaxFlows)
+			if err != nil {
+				return fmt.Errorf("read config: udp %d: %v", portNumber, err)
 			}
 		default:
 			if sectionName != "" {
@@ -165,53 +517,651 @@ func (cfg *configuration) fill(source configer) error {
 	return nil
 }
 
+// parseTCPConfig reads the settings for forwarding TCP connections from a section.
+func parseTCPConfig(source configer, sectionName string, portNumber uint16) (*tcpConfig, error) {
+	tc := &tcpConfig{connectTimeout: defaultConnectTimeout}
+	var err error
+	tc.poolConfig, err = parsePoolConfig(source, sectionName, portNumber)
+	if err != nil {
+		return nil, err
+	}
+	if tc.algorithm == "ewma" {
+		return nil, fmt.Errorf("algorithm: ewma is only supported in http sections")
+	}
+	switch s := source.Get(sectionName, "proxy-protocol"); s {
+	case "", "none":
+		tc.proxyProtocol = proxyProtocolNone
+	case "v1":
+		tc.proxyProtocol = proxyProtocolV1
+	case "v2":
+		tc.proxyProtocol = proxyProtocolV2
+	default:
+		return nil, fmt.Errorf("proxy-protocol: unknown version %q", s)
+	}
+	if s := source.Get(sectionName, "connect-retries"); s != "" {
+		tc.retries, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("connect-retries: %v", err)
+		}
+		if tc.retries < 0 {
+			return nil, fmt.Errorf("connect-retries: must not be negative")
+		}
+	}
+	tc.connectTimeout, err = parsePositiveDuration(source, sectionName, "connect-timeout", tc.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tc.access, err = parseAccessPolicy(source, sectionName)
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// parseHTTPBackendConfig reads the settings for forwarding requests
+// to backends from an http section.
+// defaultCookieName is the name of the sticky session cookie
+// if sticky-cookie-name is not set.
+func parseHTTPBackendConfig(source configer, sectionName string, portNumber uint16, defaultCookieName string) (*httpBackendConfig, error) {
+	bc := new(httpBackendConfig)
+	switch s := source.Get(sectionName, "sticky"); s {
+	case "", "none":
+	case "cookie":
+		bc.stickyCookie = defaultCookieName
+		if name := source.Get(sectionName, "sticky-cookie-name"); name != "" {
+			if !isToken(name) {
+				return nil, fmt.Errorf("sticky-cookie-name: invalid cookie name %q", name)
+			}
+			bc.stickyCookie = name
+		}
+		keyPath, err := parsePath(source, sectionName, "sticky-cookie-key-file")
+		if err != nil {
+			return nil, err
+		}
+		if keyPath != "" {
+			key, err := os.ReadFile(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("sticky-cookie-key-file: %v", err)
+			}
+			key = bytes.TrimSpace(key)
+			if len(key) < minStickyKeySize {
+				return nil, fmt.Errorf("sticky-cookie-key-file: %s must contain at least %d bytes", keyPath, minStickyKeySize)
+			}
+			bc.stickyKey = key
+		}
+	default:
+		return nil, fmt.Errorf("sticky: unknown mode %q", s)
+	}
+	var err error
+	bc.poolConfig, err = parsePoolConfig(source, sectionName, portNumber)
+	if err != nil {
+		return nil, err
+	}
+	bc.backendTLS, err = parseBackendTLSConfig(source, sectionName)
+	if err != nil {
+		return nil, err
+	}
+	switch s := source.Get(sectionName, "backend-protocol"); s {
+	case "", backendProtocolH1:
+		bc.backendProtocol = backendProtocolH1
+	case backendProtocolH2:
+		if bc.backendTLS == nil {
+			return nil, fmt.Errorf("backend-protocol: h2 requires backend-tls (use h2c for plaintext)")
+		}
+		bc.backendProtocol = s
+	case backendProtocolH2C:
+		if bc.backendTLS != nil {
+			return nil, fmt.Errorf("backend-protocol: h2c cannot be used with backend-tls (use h2)")
+		}
+		bc.backendProtocol = s
+	default:
+		return nil, fmt.Errorf("backend-protocol: unknown protocol %q", s)
+	}
+	if bc.healthCheck != nil {
+		bc.healthCheck.http, err = parseHTTPHealthCheckConfig(source, sectionName)
+		if err != nil {
+			return nil, err
+		}
+		if bc.healthCheck.http != nil {
+			bc.healthCheck.http.tls = bc.backendTLS
+			bc.healthCheck.http.protocol = bc.backendProtocol
+		}
+	}
+	return bc, nil
+}
+
+// parseHTTPRouteConfig reads a route from an [http N name] section.
+func parseHTTPRouteConfig(source configer, sectionName string, portNumber uint16, routeName string) (*httpRouteConfig, error) {
+	bc, err := parseHTTPBackendConfig(source, sectionName, portNumber, defaultStickyCookieName+"-"+routeName)
+	if err != nil {
+		return nil, err
+	}
+	rc := &httpRouteConfig{httpBackendConfig: *bc}
+	if s := source.Get(sectionName, "host"); s != "" {
+		rc.host = strings.ToLower(strings.TrimSuffix(s, "."))
+		if !isServerNamePattern(rc.host) {
+			return nil, fmt.Errorf("host: invalid host name %q", s)
+		}
+	}
+	if s := source.Get(sectionName, "path-prefix"); s != "" {
+		if !strings.HasPrefix(s, "/") {
+			return nil, fmt.Errorf("path-prefix: %q does not start with a slash", s)
+		}
+		rc.pathPrefix = s
+	}
+	if s := source.Get(sectionName, "path-regex"); s != "" {
+		rc.pathRegexp, err = regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("path-regex: %v", err)
+		}
+	}
+	for _, method := range strings.Split(source.Get(sectionName, "method"), ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			if !isToken(method) {
+				return nil, fmt.Errorf("method: invalid method %q", method)
+			}
+			rc.methods = append(rc.methods, method)
+		}
+	}
+	for _, field := range source.Find(sectionName, "header") {
+		name, value, _ := strings.Cut(field, ":")
+		name = strings.TrimSpace(name)
+		if !isToken(name) {
+			return nil, fmt.Errorf("header: invalid field name %q", name)
+		}
+		rc.headers = append(rc.headers, httpHeaderMatch{
+			name:  http.CanonicalHeaderKey(name),
+			value: strings.TrimSpace(value),
+		})
+	}
+	rc.access, err = parseAccessPolicy(source, sectionName)
+	if err != nil {
+		return nil, err
+	}
+	if rc.host == "" && rc.pathPrefix == "" && rc.pathRegexp == nil && len(rc.methods) == 0 && len(rc.headers) == 0 {
+		return nil, fmt.Errorf("route has no conditions (set host, path-prefix, path-regex, method, or header)")
+	}
+
+	if s := source.Get(sectionName, "strip-path-prefix"); s != "" {
+		strip, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("strip-path-prefix: %v", err)
+		}
+		if strip {
+			rc.rewritePath = true
+			rc.rewritePathPrefix = "/"
+		}
+	}
+	if s := source.Get(sectionName, "rewrite-path-prefix"); s != "" {
+		if rc.rewritePath {
+			return nil, fmt.Errorf("rewrite-path-prefix: cannot be used with strip-path-prefix")
+		}
+		if !strings.HasPrefix(s, "/") {
+			return nil, fmt.Errorf("rewrite-path-prefix: %q does not start with a slash", s)
+		}
+		rc.rewritePath = true
+		rc.rewritePathPrefix = s
+	}
+	if rc.rewritePath && rc.pathPrefix == "" {
+		return nil, fmt.Errorf("path prefix rewriting requires path-prefix")
+	}
+	return rc, nil
+}
+
+// parseAccessPolicy reads the allow and deny rules from a section.
+// It returns nil if the section has no rules.
+func parseAccessPolicy(source configer, sectionName string) (*accessPolicy, error) {
+	p := new(accessPolicy)
+	for _, key := range []string{"allow", "allow-user", "allow-tag", "allow-node", "deny"} {
+		// Keys like allow-user are shorthand for allow rules of one kind.
+		kind, hasKind := strings.CutPrefix(key, "allow-")
+		for _, line := range source.Find(sectionName, key) {
+			for _, s := range strings.Split(line, ",") {
+				s = strings.TrimSpace(s)
+				if s == "" {
+					continue
+				}
+				if hasKind {
+					s = kind + ":" + s
+				}
+				rule, err := parseAccessRule(s)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", key, err)
+				}
+				if key == "deny" {
+					p.deny = append(p.deny, rule)
+				} else {
+					p.allow = append(p.allow, rule)
+				}
+			}
+		}
+	}
+	if len(p.allow) == 0 && len(p.deny) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// parsePoolConfig reads the backends and load balancing settings from a section.
+func parsePoolConfig(source configer, sectionName string, portNumber uint16) (poolConfig, error) {
+	pool := poolConfig{
+		algorithm: defaultBalancingAlgorithm,
+		minDNSTTL: defaultMinDNSTTL,
+		maxDNSTTL: defaultMaxDNSTTL,
+	}
+	for _, backendAddr := range source.Find(sectionName, "backend") {
+		b, err := parseBackend(backendAddr, portNumber)
+		if err != nil {
+			return poolConfig{}, err
+		}
+		pool.backends = append(pool.backends, b)
+	}
+	if s := source.Get(sectionName, "algorithm"); s != "" {
+		if balancingAlgorithms[s] == nil {
+			return poolConfig{}, fmt.Errorf("algorithm: unknown algorithm %q", s)
+		}
+		pool.algorithm = s
+	}
+	if pool.algorithm == "hash" {
+		pool.hashKey = defaultHashKeySource
+		if s := source.Get(sectionName, "hash-key"); s != "" {
+			switch src := hashKeySource(s); src {
+			case hashKeyClientIP, hashKeyNode, hashKeyUser:
+				pool.hashKey = src
+			default:
+				return poolConfig{}, fmt.Errorf("hash-key: unknown key %q", s)
+			}
+		}
+	}
+	var err error
+	pool.slowStart, err = parsePositiveDuration(source, sectionName, "slow-start", 0)
+	if err != nil {
+		return poolConfig{}, err
+	}
+	pool.minDNSTTL, err = parsePositiveDuration(source, sectionName, "dns-min-ttl", pool.minDNSTTL)
+	if err != nil {
+		return poolConfig{}, err
+	}
+	pool.maxDNSTTL, err = parsePositiveDuration(source, sectionName, "dns-max-ttl", pool.maxDNSTTL)
+	if err != nil {
+		return poolConfig{}, err
+	}
+	if pool.maxDNSTTL < pool.minDNSTTL {
+		return poolConfig{}, fmt.Errorf("dns-max-ttl: must not be less than dns-min-ttl")
+	}
+	pool.healthCheck, err = parseHealthCheckConfig(source, sectionName)
+	if err != nil {
+		return poolConfig{}, err
+	}
+	pool.outlierDetection, err = parseOutlierDetectionConfig(source, sectionName)
+	if err != nil {
+		return poolConfig{}, err
+	}
+	return pool, nil
+}
+
+// parseHealthCheckConfig reads the health check settings from a section.
+// It returns nil if health checks are not enabled for the section.
+func parseHealthCheckConfig(source configer, sectionName string) (*healthCheckConfig, error) {
+	if s := source.Get(sectionName, "health-check"); s == "" {
+		return nil, nil
+	} else if enabled, err := strconv.ParseBool(s); err != nil {
+		return nil, fmt.Errorf("health-check: %v", err)
+	} else if !enabled {
+		return nil, nil
+	}
+
+	hc := &healthCheckConfig{
+		interval: defaultHealthCheckInterval,
+		timeout:  defaultHealthCheckTimeout,
+		rise:     defaultHealthCheckRise,
+		fall:     defaultHealthCheckFall,
+	}
+	var err error
+	if hc.interval, err = parsePositiveDuration(source, sectionName, "health-check-interval", hc.interval); err != nil {
+		return nil, err
+	}
+	if hc.timeout, err = parsePositiveDuration(source, sectionName, "health-check-timeout", hc.timeout); err != nil {
+		return nil, err
+	}
+	if hc.rise, err = parsePositiveInt(source, sectionName, "health-check-rise", hc.rise); err != nil {
+		return nil, err
+	}
+	if hc.fall, err = parsePositiveInt(source, sectionName, "health-check-fall", hc.fall); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// parseOutlierDetectionConfig reads the outlier detection settings from a section.
+// It returns nil if outlier detection is not enabled for the section.
+func parseOutlierDetectionConfig(source configer, sectionName string) (*outlierDetectionConfig, error) {
+	if s := source.Get(sectionName, "outlier-detection"); s == "" {
+		return nil, nil
+	} else if enabled, err := strconv.ParseBool(s); err != nil {
+		return nil, fmt.Errorf("outlier-detection: %v", err)
+	} else if !enabled {
+		return nil, nil
+	}
+
+	od := &outlierDetectionConfig{
+		consecutiveFailures: defaultOutlierConsecutiveFailures,
+		baseEjectionTime:    defaultOutlierBaseEjectionTime,
+		maxEjectionTime:     defaultOutlierMaxEjectionTime,
+		maxEjectionPercent:  defaultOutlierMaxEjectionPercent,
+	}
+	var err error
+	if od.consecutiveFailures, err = parsePositiveInt(source, sectionName, "outlier-consecutive-failures", od.consecutiveFailures); err != nil {
+		return nil, err
+	}
+	if od.baseEjectionTime, err = parsePositiveDuration(source, sectionName, "outlier-base-ejection-time", od.baseEjectionTime); err != nil {
+		return nil, err
+	}
+	if od.maxEjectionTime, err = parsePositiveDuration(source, sectionName, "outlier-max-ejection-time", od.maxEjectionTime); err != nil {
+		return nil, err
+	}
+	if od.maxEjectionTime < od.baseEjectionTime {
+		return nil, fmt.Errorf("outlier-max-ejection-time: must not be less than outlier-base-ejection-time")
+	}
+	if od.maxEjectionPercent, err = parsePositiveInt(source, sectionName, "outlier-max-ejection-percent", od.maxEjectionPercent); err != nil {
+		return nil, err
+	}
+	if od.maxEjectionPercent > 100 {
+		return nil, fmt.Errorf("outlier-max-ejection-percent: must not be greater than 100")
+	}
+	return od, nil
+}
+
+// parseHTTPHealthCheckConfig reads the HTTP health check settings from a section.
+// It returns nil if the section does not specify a health check path.
+func parseHTTPHealthCheckConfig(source configer, sectionName string) (*httpHealthCheckConfig, error) {
+	path := source.Get(sectionName, "health-check-path")
+	if path == "" {
+		return nil, nil
+	}
+	if u, err := url.ParseRequestURI(path); err != nil || u.Scheme != "" || u.Host != "" {
+		return nil, fmt.Errorf("health-check-path: %q is not an absolute path", path)
+	}
+	hc := &httpHealthCheckConfig{
+		method:    http.MethodGet,
+		path:      path,
+		host:      source.Get(sectionName, "health-check-host"),
+		minStatus: 200,
+		maxStatus: 399,
+		body:      source.Get(sectionName, "health-check-body"),
+	}
+	if s := source.Get(sectionName, "health-check-method"); s != "" {
+		if !isToken(s) {
+			return nil, fmt.Errorf("health-check-method: invalid method %q", s)
+		}
+		hc.method = s
+	}
+	if s := source.Get(sectionName, "health-check-status"); s != "" {
+		var err error
+		hc.minStatus, hc.maxStatus, err = parseStatusRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("health-check-status: %v", err)
+		}
+	}
+	return hc, nil
+}
+
+// parseStatusRange parses an HTTP status code (like "200")
+// or an inclusive range of status codes (like "200-299").
+func parseStatusRange(s string) (lo, hi int, err error) {
+	loString, hiString, isRange := strings.Cut(s, "-")
+	lo, err = parseStatusCode(strings.TrimSpace(loString))
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	hi, err = parseStatusCode(strings.TrimSpace(hiString))
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("invalid status range %q", s)
+	}
+	return lo, hi, nil
+}
+
+func parseStatusCode(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 999 {
+		return 0, fmt.Errorf("invalid status code %q", s)
+	}
+	return code, nil
+}
+
+// parseBackendTLSConfig reads the settings for connecting to backends
+// over TLS from a section.
+// It returns nil if backend-tls is not enabled.
+func parseBackendTLSConfig(source configer, sectionName string) (*tls.Config, error) {
+	s := source.Get(sectionName, "backend-tls")
+	if s == "" {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("backend-tls: %v", err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName: source.Get(sectionName, "backend-tls-server-name"),
+	}
+	caPath, err := parsePath(source, sectionName, "backend-tls-ca")
+	if err != nil {
+		return nil, err
+	}
+	if caPath != "" {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("backend-tls-ca: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend-tls-ca: no certificates found in %s", caPath)
+		}
+	}
+	certPath, err := parsePath(source, sectionName, "backend-tls-cert")
+	if err != nil {
+		return nil, err
+	}
+	keyPath, err := parsePath(source, sectionName, "backend-tls-key")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case certPath != "" && keyPath != "":
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("backend-tls-cert: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case certPath != "":
+		return nil, fmt.Errorf("backend-tls-cert: backend-tls-key must also be set")
+	case keyPath != "":
+		return nil, fmt.Errorf("backend-tls-key: backend-tls-cert must also be set")
+	}
+	if s := source.Get(sectionName, "backend-tls-insecure-skip-verify"); s != "" {
+		cfg.InsecureSkipVerify, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("backend-tls-insecure-skip-verify: %v", err)
+		}
+	}
+	return cfg, nil
+}
+
+// parsePath returns the value of the given key as a file path,
+// resolving relative paths against the directory
+// of the configuration file the key appears in.
+// It returns the empty string if the key is not set.
+func parsePath(source configer, sectionName, key string) (string, error) {
+	v := source.Value(sectionName, key)
+	if v == nil || v.Value == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(v.Value) {
+		return v.Value, nil
+	}
+	if v.Filename == "" {
+		return "", fmt.Errorf("configuration value for %s (line %d) has no file", key, v.Line)
+	}
+	return filepath.Join(filepath.Dir(v.Filename), v.Value), nil
+}
+
+// isServerNamePattern reports whether s is a valid DNS hostname,
+// optionally with a leading "*." wildcard label.
+func isServerNamePattern(s string) bool {
+	s = strings.TrimPrefix(s, "*.")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isToken reports whether s is a valid HTTP token
+// as defined in RFC 9110 Section 5.6.2.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePositiveDuration parses the given key as a [time.Duration],
+// returning def if the key is not set.
+func parsePositiveDuration(source configer, sectionName, key string, def time.Duration) (time.Duration, error) {
+	s := source.Get(sectionName, key)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s: must be positive", key)
+	}
+	return d, nil
+}
+
+// parsePositiveInt parses the given key as a decimal integer,
+// returning def if the key is not set.
+func parsePositiveInt(source configer, sectionName, key string, def int) (int, error) {
+	s := source.Get(sectionName, key)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s: must be positive", key)
+	}
+	return n, nil
+}
+
+// maxBackendWeight is the largest weight that can be given to a backend.
+// It keeps weights multiplied by SRV record weights well within range.
+const maxBackendWeight = 1000
+
 type backend struct {
 	addr     netip.Addr
 	hostname string
 	port     uint16
 	srv      bool
+	// weight is the relative share of traffic
+	// that each of the backend's addresses should receive.
+	// Zero is treated the same as 1.
+	weight int
 }
 
 func parseBackend(s string, implicitPort uint16) (*backend, error) {
-	const srvPrefix = "srv"
-	if len(s) >= len(srvPrefix)+1 && s[:len(srvPrefix)] == srvPrefix {
-		if c, size := utf8.DecodeRuneInString(s[len(srvPrefix):]); unicode.IsSpace(c) {
-			return &backend{
-				hostname: strings.TrimLeftFunc(s[len(srvPrefix)+size:], unicode.IsSpace),
-				srv:      true,
-			}, nil
-		}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("parse backend: empty")
 	}
-
 	b := new(backend)
-	host, portString, err := net.SplitHostPort(s)
-	if err != nil {
-		host = s
-		b.port = implicitPort
+	var options []string
+	if fields[0] == "srv" && len(fields) > 1 {
+		b.hostname = fields[1]
+		b.srv = true
+		options = fields[2:]
 	} else {
-		port, err := strconv.ParseUint(portString, 10, 16)
+		host, portString, err := net.SplitHostPort(fields[0])
 		if err != nil {
-			return nil, fmt.Errorf("parse backend %q: invalid port", s)
+			host = fields[0]
+			b.port = implicitPort
+		} else {
+			port, err := strconv.ParseUint(portString, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("parse backend %q: invalid port", s)
+			}
+			b.port = uint16(port)
+		}
+		if addr, err := netip.ParseAddr(host); err == nil {
+			b.addr = addr
+		} else {
+			b.hostname = host
 		}
-		b.port = uint16(port)
+		options = fields[1:]
 	}
-	if addr, err := netip.ParseAddr(host); err == nil {
-		b.addr = addr
-	} else {
-		b.hostname = host
+
+	for _, opt := range options {
+		k, v, _ := strings.Cut(opt, "=")
+		switch k {
+		case "weight":
+			w, err := strconv.Atoi(v)
+			if err != nil || w <= 0 || w > maxBackendWeight {
+				return nil, fmt.Errorf("parse backend %q: weight must be an integer between 1 and %d", s, maxBackendWeight)
+			}
+			b.weight = w
+		default:
+			return nil, fmt.Errorf("parse backend %q: unknown option %q", s, k)
+		}
 	}
 	return b, nil
 }
 
 func (b *backend) String() string {
+	var s string
 	if b.srv {
-		return "srv " + b.hostname
+		s = "srv " + b.hostname
+	} else {
+		host := b.hostname
+		if b.addr.IsValid() {
+			host = b.addr.String()
+		}
+		s = net.JoinHostPort(host, strconv.Itoa(int(b.port)))
 	}
-	host := b.hostname
-	if b.addr.IsValid() {
-		host = b.addr.String()
+	if b.weight > 1 {
+		s += " weight=" + strconv.Itoa(b.weight)
 	}
-	return net.JoinHostPort(host, strconv.Itoa(int(b.port)))
+	return s
 }
 
 type configer interface {
@@ -18,9 +18,12 @@ package main
 
 import (
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/ini"
 )
 
 func TestParseBackend(t *testing.T) {
@@ -57,6 +60,21 @@ func TestParseBackend(t *testing.T) {
 			hostname: "srv.example.com",
 			port:     80,
 		}},
+		{"127.0.0.1:8080 weight=3", 80, &backend{
+			addr:   netip.MustParseAddr("127.0.0.1"),
+			port:   8080,
+			weight: 3,
+		}},
+		{"example.com  weight=2", 80, &backend{
+			hostname: "example.com",
+			port:     80,
+			weight:   2,
+		}},
+		{"srv example.com weight=10", 80, &backend{
+			hostname: "example.com",
+			srv:      true,
+			weight:   10,
+		}},
 	}
 	for _, test := range tests {
 		got, err := parseBackend(test.s, test.implicitPort)
@@ -73,4 +91,231 @@ func TestParseBackend(t *testing.T) {
 			t.Errorf("parseBackend(%q, %d) (-want +got):\n%s", test.s, test.implicitPort, diff)
 		}
 	}
+
+	badInputs := []string{
+		"",
+		"127.0.0.1:http",
+		"127.0.0.1 weight=0",
+		"127.0.0.1 weight=-1",
+		"127.0.0.1 weight=abc",
+		"127.0.0.1 weight=1001",
+		"127.0.0.1 bogus=1",
+	}
+	for _, s := range badInputs {
+		if got, err := parseBackend(s, 80); err == nil {
+			t.Errorf("parseBackend(%q, 80) = %v, <nil>; want error", s, got)
+		}
+	}
+}
+
+func TestParseHealthCheckConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		ini     string
+		want    *healthCheckConfig
+		wantErr bool
+	}{
+		{
+			name: "Unset",
+			ini:  "[tcp 22]\nbackend = 127.0.0.1\n",
+			want: nil,
+		},
+		{
+			name: "Disabled",
+			ini:  "[tcp 22]\nhealth-check = false\n",
+			want: nil,
+		},
+		{
+			name: "Defaults",
+			ini:  "[tcp 22]\nhealth-check = true\n",
+			want: &healthCheckConfig{
+				interval: defaultHealthCheckInterval,
+				timeout:  defaultHealthCheckTimeout,
+				rise:     defaultHealthCheckRise,
+				fall:     defaultHealthCheckFall,
+			},
+		},
+		{
+			name: "Custom",
+			ini: "[tcp 22]\n" +
+				"health-check = true\n" +
+				"health-check-interval = 30s\n" +
+				"health-check-timeout = 1s\n" +
+				"health-check-rise = 5\n" +
+				"health-check-fall = 1\n",
+			want: &healthCheckConfig{
+				interval: 30 * time.Second,
+				timeout:  1 * time.Second,
+				rise:     5,
+				fall:     1,
+			},
+		},
+		{
+			name: "HTTP",
+			ini: "[tcp 22]\n" +
+				"health-check = true\n" +
+				"health-check-path = /healthz?full=1\n" +
+				"health-check-method = HEAD\n" +
+				"health-check-host = example.com\n" +
+				"health-check-status = 200-204\n" +
+				"health-check-body = OK\n",
+			want: &healthCheckConfig{
+				interval: defaultHealthCheckInterval,
+				timeout:  defaultHealthCheckTimeout,
+				rise:     defaultHealthCheckRise,
+				fall:     defaultHealthCheckFall,
+				http: &httpHealthCheckConfig{
+					method:    "HEAD",
+					path:      "/healthz?full=1",
+					host:      "example.com",
+					minStatus: 200,
+					maxStatus: 204,
+					body:      "OK",
+				},
+			},
+		},
+		{
+			name:    "RelativePath",
+			ini:     "[tcp 22]\nhealth-check = true\nhealth-check-path = healthz\n",
+			wantErr: true,
+		},
+		{
+			name:    "BadStatusRange",
+			ini:     "[tcp 22]\nhealth-check = true\nhealth-check-path = /\nhealth-check-status = 299-200\n",
+			wantErr: true,
+		},
+		{
+			name:    "NegativeInterval",
+			ini:     "[tcp 22]\nhealth-check = true\nhealth-check-interval = -1s\n",
+			wantErr: true,
+		},
+		{
+			name:    "ZeroFall",
+			ini:     "[tcp 22]\nhealth-check = true\nhealth-check-fall = 0\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ini.Parse(strings.NewReader(test.ini), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseHealthCheckConfig(f, "tcp 22")
+			if err == nil && got != nil {
+				got.http, err = parseHTTPHealthCheckConfig(f, "tcp 22")
+			}
+			if err != nil {
+				if !test.wantErr {
+					t.Fatal("parseHealthCheckConfig:", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("parseHealthCheckConfig(...) = %+v, <nil>; want error", got)
+			}
+			if diff := cmp.Diff(test.want, got, cmp.AllowUnexported(healthCheckConfig{}, httpHealthCheckConfig{})); diff != "" {
+				t.Errorf("parseHealthCheckConfig(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTLSSections(t *testing.T) {
+	const input = "[tls 443]\n" +
+		"backend = 127.0.0.1:8443\n" +
+		"[tls 443 app.example.com]\n" +
+		"backend = 127.0.0.2\n" +
+		"[tls 443 *.example.org]\n" +
+		"backend = 127.0.0.3\n" +
+		"proxy-protocol = v1\n"
+	f, err := ini.Parse(strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(configuration)
+	if err := cfg.fill(f); err != nil {
+		t.Fatal(err)
+	}
+	tc := cfg.ports[443].tls
+	if tc == nil {
+		t.Fatal("port 443 is not a tls port")
+	}
+	if tc.defaultRoute == nil || len(tc.defaultRoute.backends) != 1 || tc.defaultRoute.backends[0].port != 8443 {
+		t.Errorf("default route = %+v; want backend on port 8443", tc.defaultRoute)
+	}
+	if route := tc.routes["app.example.com"]; route == nil || len(route.backends) != 1 || route.backends[0].port != 443 {
+		t.Errorf("app.example.com route = %+v; want backend on port 443", route)
+	}
+	if route := tc.routes["*.example.org"]; route == nil || route.proxyProtocol != proxyProtocolV1 {
+		t.Errorf("*.example.org route = %+v; want PROXY protocol v1", route)
+	}
+
+	for _, bad := range []string{
+		"[tcp 443]\nbackend = 127.0.0.1\n[tls 443 app.example.com]\nbackend = 127.0.0.2\n",
+		"[tls 443 bad_name!]\nbackend = 127.0.0.1\n",
+		"[tls 443 *.*.example.com]\nbackend = 127.0.0.1\n",
+	} {
+		f, err := ini.Parse(strings.NewReader(bad), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := new(configuration).fill(f); err == nil {
+			t.Errorf("fill(%q) did not return an error", bad)
+		}
+	}
+}
+
+func TestBackendProtocol(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			input: "[http 80]\nbackend = 127.0.0.1\n",
+			want:  backendProtocolH1,
+		},
+		{
+			input: "[http 80]\nbackend = 127.0.0.1\nbackend-protocol = h2c\n",
+			want:  backendProtocolH2C,
+		},
+		{
+			input: "[http 80]\nbackend = 127.0.0.1\nbackend-protocol = h2\nbackend-tls = true\n",
+			want:  backendProtocolH2,
+		},
+		{
+			input:   "[http 80]\nbackend = 127.0.0.1\nbackend-protocol = h2\n",
+			wantErr: true,
+		},
+		{
+			input:   "[http 80]\nbackend = 127.0.0.1\nbackend-protocol = h2c\nbackend-tls = true\n",
+			wantErr: true,
+		},
+		{
+			input:   "[http 80]\nbackend = 127.0.0.1\nbackend-protocol = h3\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		f, err := ini.Parse(strings.NewReader(test.input), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := new(configuration)
+		err = cfg.fill(f)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("fill(%q) did not return an error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("fill(%q): %v", test.input, err)
+			continue
+		}
+		if got := cfg.ports[80].http.backendProtocol; got != test.want {
+			t.Errorf("fill(%q) backend protocol = %q; want %q", test.input, got, test.want)
+		}
+	}
 }
@@ -0,0 +1,211 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newSystemResolver returns a resolver that uses the system's DNS configuration
+// and reports the TTLs of the DNS responses it receives
+// to the [ttlRecorder] attached to the lookup's Context.
+func newSystemResolver() *ttlResolver {
+	return &ttlResolver{
+		goResolver: &net.Resolver{
+			// The pure Go resolver is the only one that lets us see DNS messages.
+			PreferGo: true,
+			Dial:     dialDNS,
+		},
+		fallback: net.DefaultResolver,
+	}
+}
+
+// ttlResolver is a resolver that looks up names with the pure Go resolver
+// so that it can observe TTLs,
+// and falls back to another resolver for names the Go resolver can't find.
+// The fallback catches names that only the platform resolver knows about,
+// like those from nsswitch sources or the macOS resolver.
+// Lookups answered by the fallback don't report TTLs.
+type ttlResolver struct {
+	goResolver *net.Resolver
+	fallback   *net.Resolver
+}
+
+func (r *ttlResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, err := r.goResolver.LookupNetIP(ctx, network, host)
+	if err == nil || r.fallback == nil || ctx.Err() != nil {
+		return addrs, err
+	}
+	if fallbackAddrs, fallbackErr := r.fallback.LookupNetIP(ctx, network, host); fallbackErr == nil {
+		return fallbackAddrs, nil
+	}
+	return nil, err
+}
+
+func (r *ttlResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname, addrs, err := r.goResolver.LookupSRV(ctx, service, proto, name)
+	if err == nil || r.fallback == nil || ctx.Err() != nil {
+		return cname, addrs, err
+	}
+	if fallbackCNAME, fallbackAddrs, fallbackErr := r.fallback.LookupSRV(ctx, service, proto, name); fallbackErr == nil {
+		return fallbackCNAME, fallbackAddrs, nil
+	}
+	return "", nil, err
+}
+
+func dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	rec := ttlRecorderFromContext(ctx)
+	if rec == nil {
+		return conn, nil
+	}
+	// The Go resolver determines how to frame messages
+	// based on whether the connection is a net.PacketConn.
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		return &ttlPacketConn{UDPConn: udpConn, rec: rec}, nil
+	}
+	return &ttlStreamConn{Conn: conn, rec: rec}, nil
+}
+
+// A ttlRecorder tracks the minimum TTL of the DNS responses
+// received over the course of one or more lookups.
+type ttlRecorder struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	ok  bool
+}
+
+type ttlRecorderContextKey struct{}
+
+// withTTLRecorder returns a new Context that carries the given recorder.
+// Lookups made with the Context from a [newSystemResolver] resolver
+// will report their TTLs to rec.
+func withTTLRecorder(ctx context.Context, rec *ttlRecorder) context.Context {
+	return context.WithValue(ctx, ttlRecorderContextKey{}, rec)
+}
+
+func ttlRecorderFromContext(ctx context.Context) *ttlRecorder {
+	rec, _ := ctx.Value(ttlRecorderContextKey{}).(*ttlRecorder)
+	return rec
+}
+
+// record notes that a DNS record was received with the given TTL.
+func (rec *ttlRecorder) record(ttl time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !rec.ok || ttl < rec.ttl {
+		rec.ttl = ttl
+		rec.ok = true
+	}
+}
+
+// min returns the minimum TTL recorded.
+// ok is false if no TTLs have been recorded,
+// such as when names are resolved from the hosts file.
+func (rec *ttlRecorder) min() (_ time.Duration, ok bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.ttl, rec.ok
+}
+
+// recordMessage records the TTLs of the answers in a DNS response.
+// It ignores malformed messages and messages that don't match the query ID.
+func (rec *ttlRecorder) recordMessage(queryID uint16, msg []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response || h.ID != queryID {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err != nil {
+			// Either dnsmessage.ErrSectionDone or a malformed message.
+			return
+		}
+		rec.record(time.Duration(ah.TTL) * time.Second)
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// ttlPacketConn is a DNS-over-UDP connection
+// that reports the TTLs of the responses read from it.
+type ttlPacketConn struct {
+	*net.UDPConn
+	rec     *ttlRecorder
+	queryID uint16
+}
+
+func (c *ttlPacketConn) Write(p []byte) (int, error) {
+	if len(p) >= 2 {
+		c.queryID = binary.BigEndian.Uint16(p)
+	}
+	return c.UDPConn.Write(p)
+}
+
+func (c *ttlPacketConn) Read(p []byte) (int, error) {
+	n, err := c.UDPConn.Read(p)
+	if n > 0 {
+		c.rec.recordMessage(c.queryID, p[:n])
+	}
+	return n, err
+}
+
+// ttlStreamConn is a DNS-over-TCP connection
+// that reports the TTLs of the responses read from it.
+type ttlStreamConn struct {
+	net.Conn
+	rec     *ttlRecorder
+	queryID uint16
+	buf     []byte
+}
+
+func (c *ttlStreamConn) Write(p []byte) (int, error) {
+	// Messages are prefixed with a two-byte length.
+	if len(p) >= 4 {
+		c.queryID = binary.BigEndian.Uint16(p[2:])
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *ttlStreamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	for len(c.buf) >= 2 {
+		msgLen := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+msgLen {
+			break
+		}
+		c.rec.recordMessage(c.queryID, c.buf[2:2+msgLen])
+		c.buf = c.buf[2+msgLen:]
+	}
+	return n, err
+}
@@ -0,0 +1,191 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestSystemResolverTTL(t *testing.T) {
+	const wantTTL = 42 * time.Second
+	wantAddr := netip.MustParseAddr("192.0.2.1")
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveFakeDNS(pc, map[string]netip.Addr{"example.com.": wantAddr}, uint32(wantTTL/time.Second))
+
+	r := newSystemResolver()
+	r.goResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialDNS(ctx, network, pc.LocalAddr().String())
+	}
+	r.fallback = nil
+	rec := new(ttlRecorder)
+	ctx := withTTLRecorder(context.Background(), rec)
+	addrs, err := r.LookupNetIP(ctx, "ip4", "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Unmap() != wantAddr {
+		t.Errorf("LookupNetIP(ctx, \"ip4\", \"example.com.\") = %v; want [%v]", addrs, wantAddr)
+	}
+	if got, ok := rec.min(); got != wantTTL || !ok {
+		t.Errorf("rec.min() = %v, %t; want %v, true", got, ok, wantTTL)
+	}
+}
+
+func TestSystemResolverFallback(t *testing.T) {
+	wantAddr := netip.MustParseAddr("192.0.2.2")
+	goPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goPC.Close()
+	go serveFakeDNS(goPC, nil, 60)
+	fallbackPC, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fallbackPC.Close()
+	go serveFakeDNS(fallbackPC, map[string]netip.Addr{"printer.local.": wantAddr}, 60)
+
+	r := newSystemResolver()
+	r.goResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialDNS(ctx, network, goPC.LocalAddr().String())
+	}
+	r.fallback = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, fallbackPC.LocalAddr().String())
+		},
+	}
+	rec := new(ttlRecorder)
+	ctx := withTTLRecorder(context.Background(), rec)
+	addrs, err := r.LookupNetIP(ctx, "ip4", "printer.local.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Unmap() != wantAddr {
+		t.Errorf("LookupNetIP(ctx, \"ip4\", \"printer.local.\") = %v; want [%v]", addrs, wantAddr)
+	}
+	if got, ok := rec.min(); ok {
+		t.Errorf("rec.min() = %v, true; want false for fallback lookup", got)
+	}
+
+	if addrs, err := r.LookupNetIP(ctx, "ip4", "missing.example.com."); err == nil {
+		t.Errorf("LookupNetIP(ctx, \"ip4\", \"missing.example.com.\") = %v, <nil>; want error", addrs)
+	}
+}
+
+func TestTTLStreamConn(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 123, Response: true})
+	b.StartAnswers()
+	name := dnsmessage.MustNewName("example.com.")
+	for _, ttl := range []uint32{300, 60, 120} {
+		b.AResource(dnsmessage.ResourceHeader{
+			Name:  name,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// Read the query, then send the response one byte at a time.
+		query := make([]byte, 4)
+		if _, err := server.Read(query); err != nil {
+			return
+		}
+		for i := range framed {
+			if _, err := server.Write(framed[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+	rec := new(ttlRecorder)
+	conn := &ttlStreamConn{Conn: client, rec: rec}
+	if _, err := conn.Write([]byte{0, 2, 0, 123}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(framed))
+	for n := 0; n < len(buf); {
+		nn, err := conn.Read(buf[n:])
+		n += nn
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, ok := rec.min(); got != 60*time.Second || !ok {
+		t.Errorf("rec.min() = %v, %t; want 1m0s, true", got, ok)
+	}
+}
+
+// serveFakeDNS answers A queries on pc using the given records
+// until pc is closed.
+func serveFakeDNS(pc net.PacketConn, records map[string]netip.Addr, ttl uint32) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:            h.ID,
+			Response:      true,
+			Authoritative: true,
+		})
+		b.EnableCompression()
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		if a, ok := records[q.Name.String()]; ok && q.Type == dnsmessage.TypeA {
+			b.AResource(dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Class: dnsmessage.ClassINET,
+				TTL:   ttl,
+			}, dnsmessage.AResource{A: a.As4()})
+		}
+		resp, err := b.Finish()
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(resp, addr)
+	}
+}
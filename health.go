@@ -0,0 +1,197 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"zombiezen.com/go/log"
+)
+
+// A probeFunc checks whether a backend address is able to serve traffic.
+type probeFunc func(ctx context.Context, addr netip.AddrPort) error
+
+// healthChecker periodically probes a load balancer's addresses
+// and takes unhealthy addresses out of rotation.
+type healthChecker struct {
+	lb     *loadBalancer
+	config *healthCheckConfig
+	probe  probeFunc
+
+	// status is only accessed by the goroutine calling check.
+	status map[netip.AddrPort]*healthStatus
+}
+
+type healthStatus struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+func newHealthChecker(lb *loadBalancer, config *healthCheckConfig, probe probeFunc) *healthChecker {
+	return &healthChecker{
+		lb:     lb,
+		config: config,
+		probe:  probe,
+		status: make(map[netip.AddrPort]*healthStatus),
+	}
+}
+
+// run checks the load balancer's addresses on the configured interval
+// until the Context is canceled.
+func (hc *healthChecker) run(ctx context.Context) {
+	tick := time.NewTicker(hc.config.interval)
+	defer tick.Stop()
+	for {
+		hc.check(ctx)
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			log.Debugf(ctx, "Stopping health checks: %v", ctx.Err())
+			return
+		}
+	}
+}
+
+// check probes every address once and updates the load balancer.
+func (hc *healthChecker) check(ctx context.Context) {
+	addrs, err := hc.lb.addresses(ctx)
+	if err != nil {
+		log.Warnf(ctx, "Health check: %v", err)
+		return
+	}
+
+	results := make([]error, len(addrs))
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.SetLimit(10)
+	for i, addr := range addrs {
+		i, addr := i, addr
+		grp.Go(func() error {
+			probeCtx, cancel := context.WithTimeout(grpCtx, hc.config.timeout)
+			defer cancel()
+			results[i] = hc.probe(probeCtx, addr)
+			return nil
+		})
+	}
+	grp.Wait()
+	if ctx.Err() != nil {
+		// Probes were interrupted. Don't count them as failures.
+		return
+	}
+
+	seen := make(map[netip.AddrPort]struct{}, len(addrs))
+	for i, addr := range addrs {
+		seen[addr] = struct{}{}
+		st := hc.status[addr]
+		if st == nil {
+			// Assume addresses are healthy until proven otherwise
+			// so that traffic can flow as soon as possible.
+			st = &healthStatus{healthy: true}
+			hc.status[addr] = st
+		}
+		if err := results[i]; err != nil {
+			st.successes = 0
+			st.failures++
+			log.Debugf(ctx, "Health check for %v failed (%d/%d): %v", addr, st.failures, hc.config.fall, err)
+			if st.healthy && st.failures >= hc.config.fall {
+				log.Warnf(ctx, "Backend %v is unhealthy: %v", addr, err)
+				st.healthy = false
+			}
+		} else {
+			st.failures = 0
+			st.successes++
+			if !st.healthy && st.successes >= hc.config.rise {
+				log.Infof(ctx, "Backend %v is healthy again", addr)
+				st.healthy = true
+			}
+		}
+		// Always inform the load balancer, even if there's no transition,
+		// in case the load balancer forgot about the address in the meantime.
+		hc.lb.setHealthy(addr, st.healthy)
+	}
+	for addr := range hc.status {
+		if _, ok := seen[addr]; !ok {
+			delete(hc.status, addr)
+		}
+	}
+}
+
+// tcpProbe is a [probeFunc] that reports whether a TCP connection
+// can be established to the address.
+func tcpProbe(ctx context.Context, addr netip.AddrPort) error {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// maxHealthCheckBodySize is the maximum number of bytes
+// of a response body that an HTTP health check will search.
+const maxHealthCheckBodySize = 1 << 20 // 1 MiB
+
+// httpProbe returns a [probeFunc] that sends an HTTP request to the address
+// and verifies the response.
+func httpProbe(cfg *httpHealthCheckConfig, transport http.RoundTripper) probeFunc {
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	scheme := "http"
+	if cfg.tls != nil {
+		scheme = "https"
+	}
+	return func(ctx context.Context, addr netip.AddrPort) error {
+		req, err := http.NewRequestWithContext(ctx, cfg.method, scheme+"://"+addr.String()+cfg.path, nil)
+		if err != nil {
+			return err
+		}
+		if cfg.host != "" {
+			req.Host = cfg.host
+		}
+		req.Header.Set("User-Agent", programName+" health check")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < cfg.minStatus || resp.StatusCode > cfg.maxStatus {
+			return fmt.Errorf("%s %s: http %s", cfg.method, req.URL, resp.Status)
+		}
+		if cfg.body == "" {
+			return nil
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodySize))
+		if err != nil {
+			return fmt.Errorf("%s %s: read body: %w", cfg.method, req.URL, err)
+		}
+		if !bytes.Contains(body, []byte(cfg.body)) {
+			return fmt.Errorf("%s %s: response body does not contain %q", cfg.method, req.URL, cfg.body)
+		}
+		return nil
+	}
+}
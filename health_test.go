@@ -0,0 +1,260 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/ini"
+	"zombiezen.com/go/log/testlog"
+)
+
+func TestHealthChecker(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	addr1 := netip.MustParseAddrPort("127.0.0.1:80")
+	addr2 := netip.MustParseAddrPort("127.0.0.1:81")
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: addr1.Addr(), port: addr1.Port()},
+		{addr: addr2.Addr(), port: addr2.Port()},
+	})
+	var mu sync.Mutex
+	down := make(map[netip.AddrPort]bool)
+	hc := newHealthChecker(lb, &healthCheckConfig{
+		interval: time.Second,
+		timeout:  time.Second,
+		rise:     2,
+		fall:     3,
+	}, func(ctx context.Context, addr netip.AddrPort) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if down[addr] {
+			return errors.New("bork")
+		}
+		return nil
+	})
+
+	hc.check(ctx)
+	if diff := cmp.Diff(addrSet(addr1, addr2), pickSet(ctx, t, lb, 4)); diff != "" {
+		t.Errorf("after first check, picked (-want +got):\n%s", diff)
+	}
+
+	mu.Lock()
+	down[addr2] = true
+	mu.Unlock()
+	for i := 0; i < 2; i++ {
+		hc.check(ctx)
+	}
+	if diff := cmp.Diff(addrSet(addr1, addr2), pickSet(ctx, t, lb, 4)); diff != "" {
+		t.Errorf("before fall threshold, picked (-want +got):\n%s", diff)
+	}
+	hc.check(ctx)
+	if diff := cmp.Diff(addrSet(addr1), pickSet(ctx, t, lb, 4)); diff != "" {
+		t.Errorf("after fall threshold, picked (-want +got):\n%s", diff)
+	}
+
+	mu.Lock()
+	down[addr2] = false
+	mu.Unlock()
+	hc.check(ctx)
+	if diff := cmp.Diff(addrSet(addr1), pickSet(ctx, t, lb, 4)); diff != "" {
+		t.Errorf("before rise threshold, picked (-want +got):\n%s", diff)
+	}
+	hc.check(ctx)
+	if diff := cmp.Diff(addrSet(addr1, addr2), pickSet(ctx, t, lb, 4)); diff != "" {
+		t.Errorf("after rise threshold, picked (-want +got):\n%s", diff)
+	}
+}
+
+func TestHealthCheckerAllDown(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: netip.MustParseAddr("127.0.0.1"), port: 80},
+	})
+	hc := newHealthChecker(lb, &healthCheckConfig{
+		interval: time.Second,
+		timeout:  time.Second,
+		rise:     1,
+		fall:     1,
+	}, func(ctx context.Context, addr netip.AddrPort) error {
+		return errors.New("bork")
+	})
+	hc.check(ctx)
+	if addr, err := lb.pick(ctx); err == nil {
+		t.Errorf("lb.pick(ctx) = %v, <nil>; want error", addr)
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddrPort(l.Addr().String())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if err := tcpProbe(ctx, addr); err != nil {
+		t.Errorf("tcpProbe(ctx, %v) with listener = %v; want <nil>", addr, err)
+	}
+	l.Close()
+	if err := tcpProbe(ctx, addr); err == nil {
+		t.Errorf("tcpProbe(ctx, %v) after closing listener = <nil>; want error", addr)
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	const wantHost = "health.example.com"
+	var mu sync.Mutex
+	status := http.StatusOK
+	body := "all systems go"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Host != wantHost {
+			t.Errorf("Host = %q; want %q", r.Host, wantHost)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	addr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	probe := httpProbe(&httpHealthCheckConfig{
+		method:    http.MethodGet,
+		path:      "/healthz",
+		host:      wantHost,
+		minStatus: 200,
+		maxStatus: 299,
+		body:      "go",
+	}, srv.Client().Transport)
+
+	tests := []struct {
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{status: http.StatusOK, body: "all systems go"},
+		{status: http.StatusAccepted, body: "go"},
+		{status: http.StatusServiceUnavailable, body: "all systems go", wantErr: true},
+		{status: http.StatusOK, body: "migrating", wantErr: true},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		status, body = test.status, test.body
+		mu.Unlock()
+		ctx := testlog.WithTB(context.Background(), t)
+		err := probe(ctx, addr)
+		if err != nil && !test.wantErr {
+			t.Errorf("probe with status=%d body=%q: %v", test.status, test.body, err)
+		} else if err == nil && test.wantErr {
+			t.Errorf("probe with status=%d body=%q = <nil>; want error", test.status, test.body)
+		}
+	}
+}
+
+func TestHTTPSHealthCheck(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	// Failed handshakes are expected.
+	srv.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	addr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	dir := t.TempDir()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ini     string
+		wantErr bool
+	}{
+		{
+			name: "CA",
+			ini: "[http 443]\n" +
+				"backend = " + addr.String() + "\n" +
+				"backend-tls = true\n" +
+				"backend-tls-ca = ca.pem\n" +
+				"backend-tls-server-name = example.com\n" +
+				"health-check = true\n" +
+				"health-check-path = /healthz\n",
+		},
+		{
+			name: "WrongServerName",
+			ini: "[http 443]\n" +
+				"backend = " + addr.String() + "\n" +
+				"backend-tls = true\n" +
+				"backend-tls-ca = ca.pem\n" +
+				"backend-tls-server-name = example.org\n" +
+				"health-check = true\n" +
+				"health-check-path = /healthz\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testlog.WithTB(context.Background(), t)
+			iniPath := filepath.Join(dir, test.name+".ini")
+			if err := os.WriteFile(iniPath, []byte(test.ini), 0o666); err != nil {
+				t.Fatal(err)
+			}
+			f, err := ini.ParseFiles(nil, iniPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := new(configuration)
+			if err := cfg.fill(f); err != nil {
+				t.Fatal(err)
+			}
+			probe := newHealthProbe(cfg.ports[443].http.healthCheck)
+			if err := probe(ctx, addr); err != nil && !test.wantErr {
+				t.Errorf("probe(ctx, %v): %v", addr, err)
+			} else if err == nil && test.wantErr {
+				t.Errorf("probe(ctx, %v) = <nil>; want error", addr)
+			}
+		})
+	}
+}
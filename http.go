@@ -17,33 +17,116 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"mime"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
 	"unicode/utf8"
 
 	"tailscale.com/client/tailscale"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 	"zombiezen.com/go/log"
 	"zombiezen.com/go/log/zstdlog"
 )
 
+// HTTP versions used to talk to backends.
+const (
+	// backendProtocolH1 is HTTP/1.1.
+	backendProtocolH1 = "h1"
+	// backendProtocolH2 is HTTP/2 over TLS.
+	backendProtocolH2 = "h2"
+	// backendProtocolH2C is HTTP/2 over plaintext TCP with prior knowledge.
+	backendProtocolH2C = "h2c"
+)
+
+// backendProtocols returns the set of protocols a transport should use
+// for the given backend protocol.
+func backendProtocols(protocol string) *http.Protocols {
+	p := new(http.Protocols)
+	switch protocol {
+	case backendProtocolH2:
+		p.SetHTTP2(true)
+	case backendProtocolH2C:
+		p.SetUnencryptedHTTP2(true)
+	default:
+		p.SetHTTP1(true)
+	}
+	return p
+}
+
+// serverProtocols returns the set of protocols that http sections accept
+// from clients: HTTP/1.1, HTTP/2 negotiated with ALPN,
+// and HTTP/2 over plaintext with prior knowledge (h2c).
+func serverProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
 type httpLoadBalancer struct {
 	lb           *loadBalancer
 	tailscale    *tailscale.LocalClient
 	whoisHeaders bool
 	trustXFF     bool
+	// hashKey is the source of the key passed to the load balancer.
+	// It is empty if the load balancer does not use the hash algorithm.
+	hashKey hashKeySource
+	// sticky is the cookie used to send clients to the same backend.
+	// If nil, then sticky sessions are disabled.
+	sticky *stickyCookie
+	// backendTLS is whether to connect to backends with HTTPS.
+	backendTLS bool
+	// transport is used to send requests to backends.
+	// If nil, then [http.DefaultTransport] is used.
+	// It must support trailers and streaming bodies for gRPC to work.
+	transport http.RoundTripper
+	// streamTimeout is the maximum time for a single request.
+	// Upgraded connections are exempt.
+	// If zero, then requests have no time limit.
+	streamTimeout time.Duration
+	// appCapabilities is the list of Tailscale application capabilities
+	// to forward to backends in the Tailscale-App-Capabilities header.
+	// If empty, then the header is not sent.
+	appCapabilities []tailcfg.PeerCapability
+	// access is the list of policies that must all allow
+	// a client's Tailscale identity before its request is forwarded.
+	access []*accessPolicy
+	// upgrades tracks connections that have switched protocols
+	// (like WebSockets), which [http.Server.Shutdown] does not wait for.
+	upgrades sync.WaitGroup
 }
 
 func (hlb *httpLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
+	if hlb.streamTimeout > 0 {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(hlb.streamTimeout)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			log.Debugf(ctx, "Setting read deadline for %s %s: %v", r.Method, r.URL.Path, err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			log.Debugf(ctx, "Setting write deadline for %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	}
 
 	whoisChan := make(chan *apitype.WhoIsResponse, 1)
-	if hlb.whoisHeaders {
+	if prev, ok := whoisFromContext(ctx); ok {
+		// The router already looked up the client.
+		whoisChan <- prev
+		close(whoisChan)
+	} else if hlb.whoisHeaders || hlb.hashKey.needsWhoIs() || len(hlb.access) > 0 || len(hlb.appCapabilities) > 0 {
 		go func() {
 			defer close(whoisChan)
 			whois, err := hlb.tailscale.WhoIs(ctx, r.RemoteAddr)
@@ -56,14 +139,37 @@ func (hlb *httpLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		close(whoisChan)
 	}
+	whois := sync.OnceValue(func() *apitype.WhoIsResponse { return <-whoisChan })
 
-	addr, err := hlb.lb.pick(ctx)
+	if len(hlb.access) > 0 {
+		if !hlb.checkAccess(w, r, whois()) {
+			return
+		}
+	}
+
+	opts := new(pickOptions)
+	if hlb.hashKey != "" {
+		opts.hashKey = hlb.hashKey.key(r.RemoteAddr, whois)
+	}
+	if hlb.sticky != nil {
+		opts.prefer = hlb.sticky.matcher(r)
+	}
+	addr, err := hlb.lb.pickWithOptions(ctx, opts)
 	if err != nil {
 		log.Errorf(ctx, "Finding backend for %s %s: %v", r.Method, r.URL.Path, err)
 		http.Error(w, "Could not find suitable backend for request.", http.StatusServiceUnavailable)
 		return
 	}
+	defer hlb.lb.release(ctx, addr)
+
+	upgraded := false
+	defer func() {
+		if upgraded {
+			hlb.upgrades.Done()
+		}
+	}()
 
+	start := time.Now()
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
 			// Strip any Tailscale headers out,
@@ -74,34 +180,184 @@ func (hlb *httpLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
+			scheme := "http"
+			if hlb.backendTLS {
+				scheme = "https"
+			}
 			r.SetURL(&url.URL{
-				Scheme: "http",
+				Scheme: scheme,
 				Host:   addr.String(),
 			})
 			r.Out.Host = r.In.Host
+			if hlb.sticky != nil {
+				hlb.sticky.strip(r.Out.Header)
+			}
 			if hlb.trustXFF {
 				r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
 			}
 			r.SetXForwarded()
 
 			if hlb.whoisHeaders {
-				whois := <-whoisChan
-				if whois != nil {
-					// Reference: https://tailscale.com/kb/1312/serve#identity-headers
-					setHeader(r.Out.Header, "Tailscale-User-Login", whois.UserProfile.LoginName)
-					setHeader(r.Out.Header, "Tailscale-User-Name", whois.UserProfile.DisplayName)
-					setHeader(r.Out.Header, "Tailscale-User-Profile-Pic", whois.UserProfile.ProfilePicURL)
+				if whois := whois(); whois != nil {
+					setIdentityHeaders(r.Out.Header, whois)
+				}
+			}
+			if len(hlb.appCapabilities) > 0 {
+				if whois := whois(); whois != nil {
+					if v, err := appCapabilitiesHeader(whois.CapMap, hlb.appCapabilities); err != nil {
+						log.Warnf(ctx, "Encoding app capabilities for %s: %v", r.In.RemoteAddr, err)
+					} else {
+						r.Out.Header.Set("Tailscale-App-Capabilities", v)
+					}
 				}
 			}
 		},
+		Transport: hlb.transport,
 		ErrorLog: zstdlog.New(log.Default(), &zstdlog.Options{
 			Context: ctx,
 			Level:   log.Warn,
 		}),
+		ModifyResponse: func(resp *http.Response) error {
+			hlb.lb.observeLatency(addr, time.Since(start))
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				// The connection is about to be hijacked and relayed
+				// for as long as both sides keep it open.
+				// Hijacking clears the stream timeout's deadlines.
+				hlb.upgrades.Add(1)
+				upgraded = true
+			}
+			if hlb.sticky != nil && (opts.prefer == nil || !opts.prefer(addr)) {
+				hlb.sticky.set(resp.Header, addr)
+			}
+			hlb.lb.report(ctx, addr, resp.StatusCode < 500)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if r.Context().Err() == nil {
+				// Don't penalize the backend for the client going away.
+				hlb.lb.report(ctx, addr, false)
+				hlb.lb.observeLatency(addr, max(time.Since(start), ewmaErrorPenalty))
+			}
+			log.Warnf(ctx, "Proxying %s %s to %v: %v", r.Method, r.URL.Path, addr, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
 	}
 	proxy.ServeHTTP(w, r)
 }
 
+type whoisContextKey struct{}
+
+// withWhoIs returns a new Context that carries the result
+// of a Tailscale whois lookup for the request's client,
+// so that handlers further down the chain don't repeat the lookup.
+// whois is nil if the lookup failed.
+func withWhoIs(ctx context.Context, whois *apitype.WhoIsResponse) context.Context {
+	return context.WithValue(ctx, whoisContextKey{}, whois)
+}
+
+// whoisFromContext returns the whois result stored by [withWhoIs].
+// ok is false if there is none.
+func whoisFromContext(ctx context.Context) (whois *apitype.WhoIsResponse, ok bool) {
+	whois, ok = ctx.Value(whoisContextKey{}).(*apitype.WhoIsResponse)
+	return whois, ok
+}
+
+// checkAccess reports whether the client identified by whois
+// may make the request.
+// If not, it writes a 403 Forbidden response.
+func (hlb *httpLoadBalancer) checkAccess(w http.ResponseWriter, r *http.Request, whois *apitype.WhoIsResponse) bool {
+	return checkHTTPAccess(w, r, whois, hlb.access)
+}
+
+// checkHTTPAccess reports whether all of the given policies
+// allow the client identified by whois to make the request.
+// If not, it writes a 403 Forbidden response.
+// Denials are logged.
+func checkHTTPAccess(w http.ResponseWriter, r *http.Request, whois *apitype.WhoIsResponse, policies []*accessPolicy) bool {
+	target := r.Method + " " + r.Host + r.URL.Path
+	if whois == nil {
+		logAccessDenied(r.Context(), r.RemoteAddr, target, nil, errUnidentified)
+		http.Error(w, "Forbidden: could not determine your Tailscale identity.", http.StatusForbidden)
+		return false
+	}
+	for _, p := range policies {
+		if err := p.check(whois); err != nil {
+			logAccessDenied(r.Context(), r.RemoteAddr, target, whois, err)
+			http.Error(w, "Forbidden: "+describeIdentity(whois)+" is not allowed to access this service.", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// setIdentityHeaders sets headers that describe the connecting Tailscale peer.
+// Tagged nodes are not owned by a user
+// (their user profile is a placeholder),
+// so user headers are only set for untagged nodes.
+func setIdentityHeaders(h http.Header, whois *apitype.WhoIsResponse) {
+	tagged := false
+	if node := whois.Node; node != nil {
+		tagged = node.IsTagged()
+		setHeader(h, "Tailscale-Node-Name", strings.TrimSuffix(node.Name, "."))
+		setHeader(h, "Tailscale-Node-ID", string(node.StableID))
+		setHeader(h, "Tailscale-Node-Tags", strings.Join(node.Tags, ","))
+		if node.Hostinfo.Valid() {
+			setHeader(h, "Tailscale-Node-OS", node.Hostinfo.OS())
+		}
+		ips := make([]string, 0, len(node.Addresses))
+		for _, prefix := range node.Addresses {
+			if prefix.IsSingleIP() {
+				ips = append(ips, prefix.Addr().String())
+			}
+		}
+		setHeader(h, "Tailscale-Node-IPs", strings.Join(ips, ","))
+	}
+	if whois.UserProfile != nil && !tagged {
+		// Reference: https://tailscale.com/kb/1312/serve#identity-headers
+		setHeader(h, "Tailscale-User-Login", whois.UserProfile.LoginName)
+		setHeader(h, "Tailscale-User-Name", whois.UserProfile.DisplayName)
+		setHeader(h, "Tailscale-User-Profile-Pic", whois.UserProfile.ProfilePicURL)
+	}
+}
+
+// appCapabilitiesHeader returns the value of the Tailscale-App-Capabilities
+// header: a JSON object that maps each of the given capability names
+// that the peer has to its list of values.
+// The result only contains ASCII characters.
+func appCapabilitiesHeader(capMap tailcfg.PeerCapMap, names []tailcfg.PeerCapability) (string, error) {
+	selected := make(tailcfg.PeerCapMap)
+	for _, name := range names {
+		if values, ok := capMap[name]; ok {
+			selected[name] = values
+		}
+	}
+	data, err := json.Marshal(selected)
+	if err != nil {
+		return "", err
+	}
+	// Capability values are raw JSON from the control server,
+	// so they may contain whitespace (including newlines).
+	buf := new(bytes.Buffer)
+	if err := json.Compact(buf, data); err != nil {
+		return "", err
+	}
+	// Non-ASCII characters can only appear inside JSON strings,
+	// so they can be escaped in place.
+	var sb strings.Builder
+	for _, c := range buf.String() {
+		switch {
+		case c < utf8.RuneSelf:
+			sb.WriteRune(c)
+		case c > 0xffff:
+			r1, r2 := utf16.EncodeRune(c)
+			fmt.Fprintf(&sb, "\\u%04x\\u%04x", r1, r2)
+		default:
+			fmt.Fprintf(&sb, "\\u%04x", c)
+		}
+	}
+	return sb.String(), nil
+}
+
 func setHeader(h http.Header, k, v string) {
 	if v == "" || !utf8.ValidString(v) {
 		return
@@ -17,20 +17,32 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"io"
+	stdlog "log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
+	"zombiezen.com/go/ini"
 )
 
 func TestHTTPLoadBalancer(t *testing.T) {
@@ -135,6 +147,325 @@ func TestHTTPLoadBalancer(t *testing.T) {
 	}
 }
 
+func TestHTTPErrorLatency(t *testing.T) {
+	// Reserve an address, then close it so that connections are refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := netip.MustParseAddrPort(l.Addr().String())
+	l.Close()
+
+	lb := newLoadBalancer(nil, []*backend{{
+		addr: backendAddr.Addr(),
+		port: backendAddr.Port(),
+	}})
+	lb.algorithm = ewma{}
+	proxySrv := httptest.NewServer(&httpLoadBalancer{lb: lb})
+	defer proxySrv.Close()
+
+	resp, err := proxySrv.Client().Get(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d; want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+
+	lb.mu.Lock()
+	latency := lb.queue.At(0).latency
+	lb.mu.Unlock()
+	if want := ewmaErrorPenalty.Seconds(); latency < want {
+		t.Errorf("latency after transport error = %gs; want at least %gs", latency, want)
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	const cookieName = "lb"
+	var backends []*backend
+	for i := 0; i < 2; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie(cookieName); err == nil {
+				t.Errorf("backend received %s cookie", cookieName)
+			}
+			if c, err := r.Cookie("app"); err != nil || c.Value != "xyzzy" {
+				t.Errorf("backend did not receive app cookie (Cookie = %q)", r.Header.Values("Cookie"))
+			}
+			io.WriteString(w, r.Context().Value(http.LocalAddrContextKey).(net.Addr).String())
+		}))
+		defer srv.Close()
+		addr, err := netip.ParseAddrPort(srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, &backend{addr: addr.Addr(), port: addr.Port()})
+	}
+	lb := newLoadBalancer(nil, backends)
+	proxySrv := httptest.NewServer(&httpLoadBalancer{
+		lb:     lb,
+		sticky: newStickyCookie(cookieName, nil, false),
+	})
+	defer proxySrv.Close()
+
+	// get sends a request through the proxy
+	// and returns the address of the backend that served it.
+	var cookie *http.Cookie
+	get := func() (_ netip.AddrPort, setCookie bool) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, proxySrv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&http.Cookie{Name: "app", Value: "xyzzy"})
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := proxySrv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		for _, c := range resp.Cookies() {
+			if c.Name == cookieName {
+				cookie = c
+				setCookie = true
+			}
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := netip.ParseAddrPort(string(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr, setCookie
+	}
+
+	first, setCookie := get()
+	if !setCookie {
+		t.Fatal("first response did not set cookie")
+	}
+	for i := 0; i < 4; i++ {
+		got, setCookie := get()
+		if got != first {
+			t.Errorf("request #%d served by %v; want %v", i+2, got, first)
+		}
+		if setCookie {
+			t.Errorf("request #%d set cookie again", i+2)
+		}
+	}
+
+	// Once the backend is out of rotation, requests should move to another one.
+	lb.setHealthy(first, false)
+	second, setCookie := get()
+	if second == first {
+		t.Errorf("after %v marked unhealthy, request served by it", first)
+	}
+	if !setCookie {
+		t.Error("response after backend change did not set cookie")
+	}
+	lb.setHealthy(first, true)
+	if got, _ := get(); got != second {
+		t.Errorf("after %v marked healthy, request served by %v; want %v", first, got, second)
+	}
+}
+
+func TestStickyCookieStrip(t *testing.T) {
+	const cookieName = "tailscale-lb-backend"
+	tests := []struct {
+		cookie []string
+		want   []string
+	}{
+		{
+			cookie: nil,
+			want:   nil,
+		},
+		{
+			cookie: []string{"app=xyzzy"},
+			want:   []string{"app=xyzzy"},
+		},
+		{
+			cookie: []string{cookieName + "=abc"},
+			want:   nil,
+		},
+		{
+			cookie: []string{"a=1; " + cookieName + "=abc; b=2"},
+			want:   []string{"a=1; b=2"},
+		},
+		{
+			cookie: []string{cookieName + "=abc; quoted=\"x y\"; bad\\name=1"},
+			want:   []string{"quoted=\"x y\"; bad\\name=1"},
+		},
+		{
+			cookie: []string{cookieName + "=abc", "session=s3cret"},
+			want:   []string{"session=s3cret"},
+		},
+		{
+			cookie: []string{"not-" + cookieName + "=1;" + cookieName + "=abc"},
+			want:   []string{"not-" + cookieName + "=1"},
+		},
+	}
+	sc := newStickyCookie(cookieName, nil, false)
+	for _, test := range tests {
+		h := http.Header{}
+		if test.cookie != nil {
+			h["Cookie"] = append([]string(nil), test.cookie...)
+		}
+		sc.strip(h)
+		if diff := cmp.Diff(test.want, h["Cookie"]); diff != "" {
+			t.Errorf("strip(Cookie: %q) (-want +got):\n%s", test.cookie, diff)
+		}
+	}
+}
+
+func TestStickyCookieKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sticky.key"), []byte("0123456789abcdef0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "short.key"), []byte("xyzzy\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	iniPath := filepath.Join(dir, "config.ini")
+	const iniData = "[http 80]\n" +
+		"backend = 127.0.0.1\n" +
+		"sticky = cookie\n" +
+		"sticky-cookie-key-file = sticky.key\n" +
+		"[http 8080]\n" +
+		"backend = 127.0.0.1\n" +
+		"sticky = cookie\n" +
+		"sticky-cookie-key-file = short.key\n"
+	if err := os.WriteFile(iniPath, []byte(iniData), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ini.ParseFiles(nil, iniPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := parseHTTPBackendConfig(f, "http 80", 80, defaultStickyCookieName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(bc.stickyKey), "0123456789abcdef0123456789abcdef"; got != want {
+		t.Errorf("stickyKey = %q; want %q", got, want)
+	}
+	if _, err := parseHTTPBackendConfig(f, "http 8080", 8080, defaultStickyCookieName); err == nil {
+		t.Error("parseHTTPBackendConfig with short key did not return an error")
+	}
+
+	// Cookies issued with a shared key should be recognized by another replica.
+	addr := netip.MustParseAddrPort("127.0.0.1:8080")
+	h := make(http.Header)
+	newStickyCookie(defaultStickyCookieName, bc.stickyKey, false).set(h, addr)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range (&http.Response{Header: h}).Cookies() {
+		req.AddCookie(c)
+	}
+	if match := newStickyCookie(defaultStickyCookieName, bc.stickyKey, false).matcher(req); match == nil || !match(addr) {
+		t.Error("cookie not recognized by stickyCookie with the same key")
+	}
+	if match := newStickyCookie(defaultStickyCookieName, nil, false).matcher(req); match == nil || match(addr) {
+		t.Error("cookie recognized by stickyCookie with a random key")
+	}
+}
+
+func TestHTTPBackendTLS(t *testing.T) {
+	backendSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello, TLS!\n")
+	}))
+	// Failed handshakes are expected.
+	backendSrv.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	backendSrv.StartTLS()
+	defer backendSrv.Close()
+	backendAddr := netip.MustParseAddrPort(backendSrv.Listener.Addr().String())
+
+	dir := t.TempDir()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backendSrv.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ini        string
+		wantStatus int
+	}{
+		{
+			name: "CA",
+			ini: "[http 443]\n" +
+				"backend-tls = true\n" +
+				"backend-tls-ca = ca.pem\n" +
+				"backend-tls-server-name = example.com\n",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "WrongServerName",
+			ini: "[http 443]\n" +
+				"backend-tls = true\n" +
+				"backend-tls-ca = ca.pem\n" +
+				"backend-tls-server-name = example.org\n",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name: "UnknownCA",
+			ini: "[http 443]\n" +
+				"backend-tls = true\n" +
+				"backend-tls-server-name = example.com\n",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name: "InsecureSkipVerify",
+			ini: "[http 443]\n" +
+				"backend-tls = true\n" +
+				"backend-tls-insecure-skip-verify = true\n",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iniPath := filepath.Join(dir, test.name+".ini")
+			if err := os.WriteFile(iniPath, []byte(test.ini), 0o666); err != nil {
+				t.Fatal(err)
+			}
+			f, err := ini.ParseFiles(nil, iniPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig, err := parseBackendTLSConfig(f, "http 443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Don't use certificates from the system pool.
+			if tlsConfig.RootCAs == nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+			}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			defer transport.CloseIdleConnections()
+			proxySrv := httptest.NewServer(&httpLoadBalancer{
+				lb: newLoadBalancer(nil, []*backend{{
+					addr: backendAddr.Addr(),
+					port: backendAddr.Port(),
+				}}),
+				backendTLS: true,
+				transport:  transport,
+			})
+			defer proxySrv.Close()
+
+			resp, err := proxySrv.Client().Get(proxySrv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("status = %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+		})
+	}
+}
+
 // fakeWhoIsHandler returns a fake of the Tailscale Local API
 // that implements the "WhoIs" endpoint.
 func fakeWhoIsHandler(f func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)) http.Handler {
@@ -159,3 +490,549 @@ func fakeWhoIsHandler(f func(ctx context.Context, remoteAddr string) (*apitype.W
 		w.Write(respJSON)
 	})
 }
+
+func TestHTTP2(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		tls      bool
+	}{
+		{name: "H2C", protocol: backendProtocolH2C},
+		{name: "H2", protocol: backendProtocolH2, tls: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The backend echoes each line of the request body as it arrives
+			// and sends a trailer, like a bidirectional gRPC stream.
+			backendSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ProtoMajor != 2 {
+					t.Errorf("backend received %s request; want HTTP/2", r.Proto)
+				}
+				w.Header().Set("Trailer", "Grpc-Status")
+				w.WriteHeader(http.StatusOK)
+				rc := http.NewResponseController(w)
+				if err := rc.EnableFullDuplex(); err != nil {
+					t.Error(err)
+				}
+				if err := rc.Flush(); err != nil {
+					t.Error(err)
+					return
+				}
+				s := bufio.NewScanner(r.Body)
+				for s.Scan() {
+					io.WriteString(w, s.Text()+"\n")
+					if err := rc.Flush(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				w.Header().Set("Grpc-Status", "0")
+			}))
+			backendSrv.Config.Protocols = new(http.Protocols)
+			backendSrv.Config.Protocols.SetUnencryptedHTTP2(true)
+			var backendTLS *tls.Config
+			if test.tls {
+				backendSrv.EnableHTTP2 = true
+				backendSrv.StartTLS()
+				backendTLS = &tls.Config{
+					RootCAs: backendSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+				}
+			} else {
+				backendSrv.Start()
+			}
+			defer backendSrv.Close()
+			backendAddr := netip.MustParseAddrPort(backendSrv.Listener.Addr().String())
+
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = backendTLS
+			transport.Protocols = backendProtocols(test.protocol)
+			defer transport.CloseIdleConnections()
+			proxySrv := httptest.NewUnstartedServer(&httpLoadBalancer{
+				lb: newLoadBalancer(nil, []*backend{{
+					addr: backendAddr.Addr(),
+					port: backendAddr.Port(),
+				}}),
+				backendTLS: test.tls,
+				transport:  transport,
+			})
+			proxySrv.Config.Protocols = serverProtocols()
+			proxySrv.Start()
+			defer proxySrv.Close()
+
+			clientTransport := &http.Transport{Protocols: backendProtocols(backendProtocolH2C)}
+			defer clientTransport.CloseIdleConnections()
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			req, err := http.NewRequest(http.MethodPost, proxySrv.URL, pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := clientTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Errorf("client received %s response; want HTTP/2", resp.Proto)
+			}
+			respBody := bufio.NewReader(resp.Body)
+			for _, msg := range []string{"Hello\n", "World\n"} {
+				if _, err := io.WriteString(pw, msg); err != nil {
+					t.Fatal(err)
+				}
+				// Reading the echo before the request body ends
+				// verifies that both directions are streamed.
+				got, err := respBody.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != msg {
+					t.Errorf("echo = %q; want %q", got, msg)
+				}
+			}
+			pw.Close()
+			if _, err := io.ReadAll(respBody); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resp.Trailer.Get("Grpc-Status"), "0"; got != want {
+				t.Errorf("Grpc-Status trailer = %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHTTPUpgrade(t *testing.T) {
+	// The backend switches to a line echo protocol.
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "echo")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(line)
+			if err := brw.Flush(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backendSrv.Close()
+	backendAddr := netip.MustParseAddrPort(backendSrv.Listener.Addr().String())
+
+	const streamTimeout = 100 * time.Millisecond
+	hlb := &httpLoadBalancer{
+		lb: newLoadBalancer(nil, []*backend{{
+			addr: backendAddr.Addr(),
+			port: backendAddr.Port(),
+		}}),
+		streamTimeout: streamTimeout,
+	}
+	proxySrv := httptest.NewServer(hlb)
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: echo\r\n"+
+		"\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// Outlive the stream timeout between messages.
+	for _, msg := range []string{"Hello\n", "World\n"} {
+		time.Sleep(2 * streamTimeout)
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Errorf("echo = %q; want %q", got, msg)
+		}
+	}
+
+	conn.Close()
+	done := make(chan struct{})
+	go func() {
+		hlb.upgrades.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("upgraded connection still tracked after client closed it")
+	}
+}
+
+func TestHTTPStreamTimeout(t *testing.T) {
+	const streamTimeout = 100 * time.Millisecond
+	backendDone := make(chan struct{})
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		http.NewResponseController(w).Flush()
+		select {
+		case <-time.After(10 * streamTimeout):
+			io.WriteString(w, "second\n")
+		case <-r.Context().Done():
+		case <-backendDone:
+		}
+	}))
+	defer backendSrv.Close()
+	defer close(backendDone)
+	backendAddr := netip.MustParseAddrPort(backendSrv.Listener.Addr().String())
+
+	proxySrv := httptest.NewServer(&httpLoadBalancer{
+		lb: newLoadBalancer(nil, []*backend{{
+			addr: backendAddr.Addr(),
+			port: backendAddr.Port(),
+		}}),
+		streamTimeout: streamTimeout,
+	})
+	defer proxySrv.Close()
+
+	resp, err := proxySrv.Client().Get(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("response body = %q, <nil>; want error after stream timeout", body)
+	}
+}
+
+func TestHTTPAccess(t *testing.T) {
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello, World!\n")
+	}))
+	defer backendSrv.Close()
+	backendAddr := netip.MustParseAddrPort(backendSrv.Listener.Addr().String())
+
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+
+	tests := []struct {
+		name       string
+		access     []*accessPolicy
+		wantStatus int
+	}{
+		{
+			name:       "Allowed",
+			access:     []*accessPolicy{{allow: []accessRule{{kind: accessRuleDomain, value: "example.com"}}}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "NotAllowed",
+			access:     []*accessPolicy{{allow: []accessRule{{kind: accessRuleTag, value: "tag:server"}}}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "DeniedByRoute",
+			access: []*accessPolicy{
+				{allow: []accessRule{{kind: accessRuleDomain, value: "example.com"}}},
+				{deny: []accessRule{{kind: accessRuleNode, value: "laptop"}}},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxySrv := httptest.NewServer(&httpLoadBalancer{
+				lb: newLoadBalancer(nil, []*backend{{
+					addr: backendAddr.Addr(),
+					port: backendAddr.Port(),
+				}}),
+				tailscale: &tailscale.LocalClient{
+					Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return net.Dial("tcp", tailscaleLocalAPIAddr)
+					},
+				},
+				access: test.access,
+			})
+			defer proxySrv.Close()
+
+			resp, err := proxySrv.Client().Get(proxySrv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("status = %d; want %d", resp.StatusCode, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusForbidden && !strings.Contains(string(body), "alice@example.com") {
+				t.Errorf("body = %q; want to mention alice@example.com", body)
+			}
+		})
+	}
+}
+
+func TestHTTPWhoisConfig(t *testing.T) {
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Tailscale-User-Login"))
+	}))
+	defer backendSrv.Close()
+
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+	client := &tailscale.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", tailscaleLocalAPIAddr)
+		},
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "Default",
+			input: "",
+			want:  "alice@example.com",
+		},
+		{
+			name:  "Enabled",
+			input: "whois = true\n",
+			want:  "alice@example.com",
+		},
+		{
+			name:  "Disabled",
+			input: "whois = false\n",
+			want:  "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := "[http 80]\nbackend = " + backendSrv.Listener.Addr().String() + "\n" + test.input
+			f, err := ini.Parse(strings.NewReader(input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := new(configuration)
+			if err := cfg.fill(f); err != nil {
+				t.Fatal(err)
+			}
+			hc := cfg.ports[80].http
+
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			defer func() {
+				cancel()
+				wg.Wait()
+			}()
+			proxySrv := httptest.NewServer(newHTTPLoadBalancer(ctx, &wg, fakeResolver{}, client, hc, &hc.httpBackendConfig))
+			defer proxySrv.Close()
+
+			resp, err := proxySrv.Client().Get(proxySrv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(body); got != test.want {
+				t.Errorf("Tailscale-User-Login = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAppCapabilitiesHeader(t *testing.T) {
+	capMap := tailcfg.PeerCapMap{
+		"example.com/cap/admin": {`{"level": "full",` + "\n" + `"team": "Ünits"}`},
+		"example.com/cap/read":  {`{}`, `{"bucket":"logs"}`},
+		"example.com/cap/other": {`true`},
+	}
+	tests := []struct {
+		names []tailcfg.PeerCapability
+		want  string
+	}{
+		{
+			names: []tailcfg.PeerCapability{"example.com/cap/read"},
+			want:  `{"example.com/cap/read":[{},{"bucket":"logs"}]}`,
+		},
+		{
+			names: []tailcfg.PeerCapability{"example.com/cap/admin", "example.com/cap/missing"},
+			want:  `{"example.com/cap/admin":[{"level":"full","team":"\u00dcnits"}]}`,
+		},
+		{
+			names: []tailcfg.PeerCapability{"example.com/cap/missing"},
+			want:  `{}`,
+		},
+	}
+	for _, test := range tests {
+		got, err := appCapabilitiesHeader(capMap, test.names)
+		if err != nil {
+			t.Errorf("appCapabilitiesHeader(capMap, %q): %v", test.names, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("appCapabilitiesHeader(capMap, %q) = %s; want %s", test.names, got, test.want)
+		}
+	}
+}
+
+func TestHTTPAppCapabilities(t *testing.T) {
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Tailscale-App-Capabilities"))
+	}))
+	defer backendSrv.Close()
+	backendAddr := netip.MustParseAddrPort(backendSrv.Listener.Addr().String())
+
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				CapMap: tailcfg.PeerCapMap{
+					"example.com/cap/wiki":  {`{"role":"editor"}`},
+					"example.com/cap/other": {`{"role":"admin"}`},
+				},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+
+	proxySrv := httptest.NewServer(&httpLoadBalancer{
+		lb: newLoadBalancer(nil, []*backend{{
+			addr: backendAddr.Addr(),
+			port: backendAddr.Port(),
+		}}),
+		tailscale: &tailscale.LocalClient{
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", tailscaleLocalAPIAddr)
+			},
+		},
+		appCapabilities: []tailcfg.PeerCapability{"example.com/cap/wiki"},
+	})
+	defer proxySrv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxySrv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tailscale-App-Capabilities", `{"example.com/cap/wiki":[{"role":"owner"}]}`)
+	resp, err := proxySrv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"example.com/cap/wiki":[{"role":"editor"}]}`
+	if string(got) != want {
+		t.Errorf("Tailscale-App-Capabilities = %s; want %s", got, want)
+	}
+}
+
+func TestSetIdentityHeaders(t *testing.T) {
+	hostinfo := &tailcfg.Hostinfo{OS: "linux"}
+	tests := []struct {
+		name  string
+		whois *apitype.WhoIsResponse
+		want  http.Header
+	}{
+		{
+			name: "User",
+			whois: &apitype.WhoIsResponse{
+				Node: &tailcfg.Node{
+					StableID:  "nABC123",
+					Name:      "laptop.example.ts.net.",
+					Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("fd7a:115c:a1e0::1/128")},
+					Hostinfo:  hostinfo.View(),
+				},
+				UserProfile: &tailcfg.UserProfile{
+					LoginName:   "alice@example.com",
+					DisplayName: "Alice",
+				},
+			},
+			want: http.Header{
+				"Tailscale-Node-Name":  {"laptop.example.ts.net"},
+				"Tailscale-Node-Id":    {"nABC123"},
+				"Tailscale-Node-Os":    {"linux"},
+				"Tailscale-Node-Ips":   {"100.64.0.1,fd7a:115c:a1e0::1"},
+				"Tailscale-User-Login": {"alice@example.com"},
+				"Tailscale-User-Name":  {"Alice"},
+			},
+		},
+		{
+			name: "Tagged",
+			whois: &apitype.WhoIsResponse{
+				Node: &tailcfg.Node{
+					StableID:  "nDEF456",
+					Name:      "ci.example.ts.net.",
+					Tags:      []string{"tag:ci", "tag:server"},
+					Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				},
+				UserProfile: &tailcfg.UserProfile{
+					LoginName:   "tagged-devices",
+					DisplayName: "Tagged Devices",
+				},
+			},
+			want: http.Header{
+				"Tailscale-Node-Name": {"ci.example.ts.net"},
+				"Tailscale-Node-Id":   {"nDEF456"},
+				"Tailscale-Node-Tags": {"tag:ci,tag:server"},
+				"Tailscale-Node-Ips":  {"100.64.0.2"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make(http.Header)
+			setIdentityHeaders(got, test.whois)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("headers (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
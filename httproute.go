@@ -0,0 +1,259 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+	"zombiezen.com/go/log"
+)
+
+// httpRouter chooses a handler for an HTTP request
+// based on the routes in an http section.
+type httpRouter struct {
+	// defaultRoute handles requests that don't match any route.
+	// It may be nil.
+	defaultRoute http.Handler
+	// routes is the list of routes in order of precedence.
+	routes []*httpRoute
+	// access is the section's policy, checked before routing
+	// so that denied clients can't probe which routes exist.
+	// If nil, then requests are routed without checking identity.
+	access    *accessPolicy
+	tailscale *tailscale.LocalClient
+}
+
+// httpRoute is a rule that sends matching requests to a handler.
+type httpRoute struct {
+	name    string
+	config  *httpRouteConfig
+	handler http.Handler
+}
+
+// newHTTPRoute returns a route that sends requests matching rc to h,
+// rewriting the request path if rc calls for it.
+func newHTTPRoute(name string, rc *httpRouteConfig, h http.Handler) *httpRoute {
+	if rc.rewritePath {
+		h = rewritePathPrefix(h, rc.pathPrefix, rc.rewritePathPrefix)
+	}
+	return &httpRoute{
+		name:    name,
+		config:  rc,
+		handler: h,
+	}
+}
+
+func (router *httpRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if router.access != nil {
+		whois, err := router.tailscale.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			log.Errorf(r.Context(), "Tailscale whois: %v", err)
+			whois = nil
+		}
+		if !checkHTTPAccess(w, r, whois, []*accessPolicy{router.access}) {
+			return
+		}
+		r = r.WithContext(withWhoIs(r.Context(), whois))
+	}
+	r = cleanRequestPath(r)
+	h := router.route(r)
+	if h == nil {
+		log.Debugf(r.Context(), "No route for %s %s%s", r.Method, r.Host, r.URL.Path)
+		http.Error(w, "No route for request.", http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// route returns the handler for the first route that matches r,
+// the default route if none match, or nil if there is no default route.
+func (router *httpRouter) route(r *http.Request) http.Handler {
+	host := requestHost(r)
+	for _, route := range router.routes {
+		if route.config.matches(host, r) {
+			return route.handler
+		}
+	}
+	return router.defaultRoute
+}
+
+// matches reports whether a request for the given lowercase host
+// satisfies all of the route's conditions.
+func (rc *httpRouteConfig) matches(host string, r *http.Request) bool {
+	if rc.host != "" && !matchServerName(rc.host, host) {
+		return false
+	}
+	if rc.pathPrefix != "" && !hasPathPrefix(r.URL.Path, rc.pathPrefix) {
+		return false
+	}
+	if rc.pathRegexp != nil && !rc.pathRegexp.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rc.methods) > 0 && !slices.Contains(rc.methods, r.Method) {
+		return false
+	}
+	for _, hm := range rc.headers {
+		values := r.Header[hm.name]
+		if hm.value == "" {
+			if len(values) == 0 {
+				return false
+			}
+		} else if !slices.Contains(values, hm.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortHTTPRoutes sorts routes so that more specific routes come first.
+// Routes with an exact host come before routes with a wildcard host,
+// which come before routes that match any host.
+// Next, routes with longer path prefixes come first,
+// then routes with a path regular expression,
+// then routes with more method and header conditions.
+// Remaining ties are broken by route name.
+func sortHTTPRoutes(routes []*httpRoute) {
+	hostRank := func(rc *httpRouteConfig) int {
+		switch {
+		case rc.host == "":
+			return 0
+		case strings.HasPrefix(rc.host, "*."):
+			return 1
+		default:
+			return 2
+		}
+	}
+	conditionCount := func(rc *httpRouteConfig) int {
+		n := len(rc.headers)
+		if len(rc.methods) > 0 {
+			n++
+		}
+		return n
+	}
+	slices.SortFunc(routes, func(a, b *httpRoute) int {
+		if c := cmp.Compare(hostRank(b.config), hostRank(a.config)); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(len(b.config.pathPrefix), len(a.config.pathPrefix)); c != 0 {
+			return c
+		}
+		if a.config.pathRegexp != nil && b.config.pathRegexp == nil {
+			return -1
+		}
+		if a.config.pathRegexp == nil && b.config.pathRegexp != nil {
+			return 1
+		}
+		if c := cmp.Compare(conditionCount(b.config), conditionCount(a.config)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+}
+
+// requestHost returns the lowercase host name from the request's Host header
+// without any port or trailing dot.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchServerName reports whether the lowercase name matches pattern.
+// A pattern that starts with "*." matches any single label in its place.
+func matchServerName(pattern, name string) bool {
+	if parentPattern, ok := strings.CutPrefix(pattern, "*."); ok {
+		_, parent, ok := strings.Cut(name, ".")
+		return ok && parent == parentPattern
+	}
+	return name == pattern
+}
+
+// hasPathPrefix reports whether path is equal to prefix
+// or is a descendant of prefix.
+// For example, "/wiki" matches "/wiki" and "/wiki/Main_Page",
+// but not "/wikipedia".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// replacePathPrefix replaces prefix in path with replacement.
+// path must have the given prefix.
+func replacePathPrefix(path, prefix, replacement string) string {
+	rest := strings.TrimPrefix(path[len(prefix):], "/")
+	if rest == "" {
+		return replacement
+	}
+	return strings.TrimSuffix(replacement, "/") + "/" + rest
+}
+
+// cleanRequestPath returns r with "." and ".." elements
+// and repeated slashes removed from its path,
+// so that routes match the resource the backend will serve.
+// A trailing slash is preserved.
+// If the path is already clean, cleanRequestPath returns r.
+func cleanRequestPath(r *http.Request) *http.Request {
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/") {
+		return r
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned == p {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = cleaned
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// rewritePathPrefix returns a handler that serves requests
+// by replacing prefix in the request path with replacement
+// and invoking h.
+// Like [http.StripPrefix], it only modifies a copy of the request.
+func rewritePathPrefix(h http.Handler, prefix, replacement string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = replacePathPrefix(r.URL.Path, prefix, replacement)
+		if hasPathPrefix(r.URL.RawPath, prefix) {
+			r2.URL.RawPath = replacePathPrefix(r.URL.RawPath, prefix, replacement)
+		} else {
+			r2.URL.RawPath = ""
+		}
+		h.ServeHTTP(w, r2)
+	})
+}
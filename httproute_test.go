@@ -0,0 +1,363 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"zombiezen.com/go/ini"
+)
+
+func TestHTTPRouter(t *testing.T) {
+	const input = "[http 443]\n" +
+		"backend = 127.0.0.1:8080\n" +
+		"[http 443 wiki]\n" +
+		"path-prefix = /wiki\n" +
+		"strip-path-prefix = true\n" +
+		"backend = 127.0.0.2:8080\n" +
+		"[http 443 wiki-edit]\n" +
+		"path-prefix = /wiki/edit\n" +
+		"rewrite-path-prefix = /edit/\n" +
+		"method = POST, PUT\n" +
+		"backend = 127.0.0.3:8080\n" +
+		"[http 443 grafana]\n" +
+		"path-regex = ^/grafana(/|$)\n" +
+		"backend = 127.0.0.4:8080\n" +
+		"[http 443 api]\n" +
+		"host = api.example.com\n" +
+		"backend = 127.0.0.5:8080\n" +
+		"[http 443 any-api]\n" +
+		"host = *.example.com\n" +
+		"header = X-Api-Version: 2\n" +
+		"backend = 127.0.0.6:8080\n"
+	f, err := ini.Parse(strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(configuration)
+	if err := cfg.fill(f); err != nil {
+		t.Fatal(err)
+	}
+	hc := cfg.ports[443].http
+	if hc == nil {
+		t.Fatal("port 443 is not an http port")
+	}
+
+	// Replace load balancers with handlers that report
+	// the route name and the path they received.
+	echo := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		})
+	}
+	router := &httpRouter{defaultRoute: echo("default")}
+	for name, rc := range hc.routes {
+		router.routes = append(router.routes, newHTTPRoute(name, rc, echo(name)))
+	}
+	sortHTTPRoutes(router.routes)
+
+	tests := []struct {
+		method string
+		url    string
+		header http.Header
+		want   string
+	}{
+		{method: "GET", url: "http://lb.example.com/", want: "default /"},
+		{method: "GET", url: "http://lb.example.com/wiki", want: "wiki /"},
+		{method: "GET", url: "http://lb.example.com/wiki/Main_Page", want: "wiki /Main_Page"},
+		{method: "GET", url: "http://lb.example.com/wikipedia", want: "default /wikipedia"},
+		{method: "GET", url: "http://lb.example.com/wiki/edit/Main_Page", want: "wiki /edit/Main_Page"},
+		{method: "POST", url: "http://lb.example.com/wiki/edit/Main_Page", want: "wiki-edit /edit/Main_Page"},
+		{method: "GET", url: "http://lb.example.com/grafana/d/abc", want: "grafana /grafana/d/abc"},
+		{method: "GET", url: "http://lb.example.com/grafanax", want: "default /grafanax"},
+		{method: "GET", url: "http://api.example.com/wiki", want: "api /wiki"},
+		{method: "GET", url: "http://API.example.com:443/v1", want: "api /v1"},
+		{method: "GET", url: "http://other.example.com/v1", want: "default /v1"},
+		{method: "GET", url: "http://lb.example.com/wiki/../admin/secret", want: "default /admin/secret"},
+		{method: "GET", url: "http://lb.example.com/wiki/%2e%2e/admin/secret", want: "default /admin/secret"},
+		{method: "GET", url: "http://lb.example.com/grafana/../wiki/Main_Page", want: "wiki /Main_Page"},
+		{method: "GET", url: "http://lb.example.com//wiki//Main_Page", want: "wiki /Main_Page"},
+		{method: "GET", url: "http://lb.example.com/grafana/./d/", want: "grafana /grafana/d/"},
+		{
+			method: "GET",
+			url:    "http://other.example.com/v1",
+			header: http.Header{"X-Api-Version": {"2"}},
+			want:   "any-api /v1",
+		},
+		{
+			method: "GET",
+			url:    "http://api.example.com/v1",
+			header: http.Header{"X-Api-Version": {"2"}},
+			want:   "api /v1",
+		},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		for k, v := range test.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s %s (header %v) = %q; want %q", test.method, test.url, test.header, got, test.want)
+		}
+	}
+
+	// Without a default route, unmatched requests are not found.
+	router.defaultRoute = nil
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.example.com/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET / without default route status = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestHTTPRouterAccess(t *testing.T) {
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+
+	tests := []struct {
+		name       string
+		access     *accessPolicy
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "AllowedMatch",
+			access:     &accessPolicy{allow: []accessRule{{kind: accessRuleDomain, value: "example.com"}}},
+			path:       "/wiki",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "AllowedNoMatch",
+			access:     &accessPolicy{allow: []accessRule{{kind: accessRuleDomain, value: "example.com"}}},
+			path:       "/other",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "DeniedMatch",
+			access:     &accessPolicy{deny: []accessRule{{kind: accessRuleUser, value: "alice@example.com"}}},
+			path:       "/wiki",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "DeniedNoMatch",
+			access:     &accessPolicy{deny: []accessRule{{kind: accessRuleUser, value: "alice@example.com"}}},
+			path:       "/other",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rc := &httpRouteConfig{pathPrefix: "/wiki"}
+			router := &httpRouter{
+				routes: []*httpRoute{newHTTPRoute("wiki", rc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "wiki")
+				}))},
+				access: test.access,
+				tailscale: &tailscale.LocalClient{
+					Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return net.Dial("tcp", tailscaleLocalAPIAddr)
+					},
+				},
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.example.com"+test.path, nil))
+			if rec.Code != test.wantStatus {
+				t.Errorf("GET %s status = %d; want %d", test.path, rec.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHTTPRouterTraversal(t *testing.T) {
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+	client := &tailscale.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", tailscaleLocalAPIAddr)
+		},
+	}
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backendSrv.Close()
+	backendAddr := backendSrv.Listener.Addr().String()
+
+	input := "[http 80]\n" +
+		"backend = " + backendAddr + "\n" +
+		"[http 80 public]\n" +
+		"path-prefix = /public\n" +
+		"backend = " + backendAddr + "\n" +
+		"[http 80 admin]\n" +
+		"path-prefix = /admin\n" +
+		"allow-user = bob@example.com\n" +
+		"backend = " + backendAddr + "\n"
+	f, err := ini.Parse(strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(configuration)
+	if err := cfg.fill(f); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	router, _ := newHTTPRouter(ctx, &wg, fakeResolver{}, client, cfg.ports[80].http)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{path: "/public/index.html", wantStatus: http.StatusOK},
+		{path: "/admin/secret", wantStatus: http.StatusForbidden},
+		{path: "/public/../admin/secret", wantStatus: http.StatusForbidden},
+		{path: "/public/%2e%2e/admin/secret", wantStatus: http.StatusForbidden},
+		{path: "/public/%2E%2E/admin/secret", wantStatus: http.StatusForbidden},
+		{path: "//admin/secret", wantStatus: http.StatusForbidden},
+		{path: "/public/./../admin/secret", wantStatus: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.example.com"+test.path, nil))
+		if rec.Code != test.wantStatus {
+			t.Errorf("GET %s status = %d; want %d", test.path, rec.Code, test.wantStatus)
+		}
+	}
+}
+
+func TestHTTPRouterWhoIsOnce(t *testing.T) {
+	var whoisCalls atomic.Int32
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			whoisCalls.Add(1)
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+	client := &tailscale.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", tailscaleLocalAPIAddr)
+		},
+	}
+	backendSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Tailscale-User-Login"))
+	}))
+	defer backendSrv.Close()
+
+	input := "[http 80]\n" +
+		"allow-user = alice@example.com\n" +
+		"[http 80 admin]\n" +
+		"path-prefix = /admin\n" +
+		"allow-user = alice@example.com\n" +
+		"backend = " + backendSrv.Listener.Addr().String() + "\n"
+	f, err := ini.Parse(strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(configuration)
+	if err := cfg.fill(f); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	router, _ := newHTTPRouter(ctx, &wg, fakeResolver{}, client, cfg.ports[80].http)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.example.com/admin", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /admin status = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Body.String(), "alice@example.com"; got != want {
+		t.Errorf("Tailscale-User-Login = %q; want %q", got, want)
+	}
+	if got := whoisCalls.Load(); got != 1 {
+		t.Errorf("whois called %d times; want 1", got)
+	}
+}
+
+func TestHTTPRouteConfig(t *testing.T) {
+	f, err := ini.Parse(strings.NewReader("[http 80 app]\nhost = app.example.com\nsticky = cookie\nbackend = 127.0.0.1\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(configuration)
+	if err := cfg.fill(f); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.ports[80].http.routes["app"].stickyCookie, defaultStickyCookieName+"-app"; got != want {
+		t.Errorf("sticky cookie name = %q; want %q", got, want)
+	}
+
+	for _, bad := range []string{
+		"[tcp 80]\nbackend = 127.0.0.1\n[http 80 app]\nhost = app.example.com\n",
+		"[http 80 app]\nbackend = 127.0.0.1\n",
+		"[http 80 app]\nhost = bad_name!\n",
+		"[http 80 app]\npath-prefix = wiki\n",
+		"[http 80 app]\npath-regex = (\n",
+		"[http 80 app]\nhost = app.example.com\nstrip-path-prefix = true\n",
+		"[http 80 app]\npath-prefix = /wiki\nstrip-path-prefix = true\nrewrite-path-prefix = /w\n",
+		"[http 80 bad/name]\nhost = app.example.com\n",
+	} {
+		f, err := ini.Parse(strings.NewReader(bad), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := new(configuration).fill(f); err == nil {
+			t.Errorf("fill(%q) did not return an error", bad)
+		}
+	}
+}
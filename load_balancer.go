@@ -17,12 +17,16 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"zombiezen.com/go/log"
@@ -35,176 +39,546 @@ type resolver interface {
 }
 
 type loadBalancer struct {
-	resolver   resolver
-	backends   []*backend
-	refreshSem chan struct{}
+	resolver resolver
+	backends []*backend
+	// minTTL and maxTTL bound how long resolved addresses are cached.
+	minTTL time.Duration
+	maxTTL time.Duration
+	now    func() time.Time
 
-	mu    sync.Mutex
-	queue deque.Deque[netip.AddrPort]
+	// refreshSem is a semaphore that guards resolutions.
+	refreshSem  chan struct{}
+	resolutions []resolution
+
+	// algorithm chooses among the available endpoints.
+	algorithm balancingAlgorithm
+	// slowStart is the duration over which the weight of a new
+	// or recovered address ramps up to its full weight.
+	// Zero disables slow start.
+	slowStart time.Duration
+
+	// outlierDetection is the configuration for ejecting addresses
+	// based on reported failures.
+	// If nil, then reported failures are ignored.
+	outlierDetection *outlierDetectionConfig
+
+	mu        sync.Mutex
+	resolved  bool
+	queue     deque.Deque[*endpoint]
+	unhealthy map[netip.AddrPort]struct{}
+	outliers  map[netip.AddrPort]*outlierStatus
+	// active is the number of in-flight uses of each address.
+	// Unlike the other fields,
+	// it is not cleared when an address is removed from the queue.
+	active map[netip.AddrPort]int
+}
+
+// endpoint is a single resolved backend address.
+type endpoint struct {
+	addr netip.AddrPort
+	// tier is the endpoint's rank in preference order.
+	// The load balancer only uses the lowest tier with available endpoints.
+	tier int
+	// weight is the endpoint's share of traffic relative to other endpoints
+	// in the same tier.
+	weight int
+
+	// current is the smooth weighted round-robin state.
+	// It is only modified by [roundRobin].
+	current float64
+	// latency is the decayed average response time in seconds
+	// or zero if no responses have been observed.
+	// latencyTime is the time of the last observation.
+	// They are only modified by [*endpoint.observe].
+	latency     float64
+	latencyTime time.Time
+	// since is the time the endpoint was added or became healthy again.
+	// It is zero for endpoints from the initial resolution.
+	since time.Time
 }
 
 func newLoadBalancer(r resolver, backends []*backend) *loadBalancer {
 	return &loadBalancer{
 		resolver:   r,
 		backends:   backends,
+		minTTL:     defaultMinDNSTTL,
+		maxTTL:     defaultMaxDNSTTL,
+		now:        time.Now,
 		refreshSem: make(chan struct{}, 1),
+		algorithm:  roundRobin{},
 	}
 }
 
+// pickOptions is the set of optional parameters to [*loadBalancer.pickWithOptions].
+type pickOptions struct {
+	// exclude is a set of addresses that should not be picked,
+	// usually because they have already been tried.
+	exclude map[netip.AddrPort]struct{}
+	// hashKey identifies the client for the [hashing] algorithm.
+	// Picks with the same key choose the same address
+	// as long as it remains available.
+	hashKey string
+	// prefer reports whether an address should be picked
+	// over the choice of the balancing algorithm.
+	// If prefer is not nil and returns true for an available address,
+	// then pickWithOptions returns that address.
+	prefer func(netip.AddrPort) bool
+}
+
 // pick chooses one of the available backends
 // or returns an error if none are available.
+// The caller must call [*loadBalancer.release] with the returned address
+// once it is no longer in use.
 func (lb *loadBalancer) pick(ctx context.Context) (netip.AddrPort, error) {
-	refreshErr := lb.refresh(ctx)
+	return lb.pickWithOptions(ctx, nil)
+}
+
+// pickWithOptions is like [*loadBalancer.pick]
+// but takes optional parameters.
+// opts may be nil.
+func (lb *loadBalancer) pickWithOptions(ctx context.Context, opts *pickOptions) (netip.AddrPort, error) {
+	if opts == nil {
+		opts = new(pickOptions)
+	}
+	refreshErr := lb.ensureResolved(ctx)
 
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	addr, ok := lb.queue.Front()
-	if !ok {
+	n := lb.queue.Len()
+	if n == 0 {
 		if refreshErr != nil {
 			return netip.AddrPort{}, fmt.Errorf("pick address: %w", refreshErr)
 		}
 		return netip.AddrPort{}, fmt.Errorf("pick address: no backend available")
 	}
-	lb.queue.Rotate(1)
-	return addr, nil
+	now := lb.now()
+	if opts.prefer != nil {
+		for i := 0; i < n; i++ {
+			e := lb.queue.At(i)
+			if _, skip := opts.exclude[e.addr]; !skip && opts.prefer(e.addr) && lb.isAvailableLocked(e.addr, now) {
+				lb.acquireLocked(e.addr)
+				return e.addr, nil
+			}
+		}
+	}
+	bestTier := -1
+	excluded := false
+	for i := 0; i < n; i++ {
+		e := lb.queue.At(i)
+		if _, skip := opts.exclude[e.addr]; skip {
+			excluded = true
+			continue
+		}
+		if lb.isAvailableLocked(e.addr, now) && (bestTier < 0 || e.tier < bestTier) {
+			bestTier = e.tier
+		}
+	}
+	if bestTier < 0 {
+		if excluded {
+			return netip.AddrPort{}, fmt.Errorf("pick address: no untried healthy backend available")
+		}
+		return netip.AddrPort{}, fmt.Errorf("pick address: no healthy backend available")
+	}
+
+	// Gather candidates from the tier in queue order.
+	var candidates []candidate
+	allZero := true
+	for i := 0; i < n; i++ {
+		e := lb.queue.At(i)
+		if _, skip := opts.exclude[e.addr]; skip || e.tier != bestTier || !lb.isAvailableLocked(e.addr, now) {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			endpoint: e,
+			index:    i,
+			weight:   float64(e.weight),
+			active:   lb.active[e.addr],
+		})
+		if e.weight > 0 {
+			allZero = false
+		}
+	}
+	if allZero {
+		for i := range candidates {
+			candidates[i].weight = 1
+		}
+	} else {
+		// Zero-weight endpoints are only used
+		// if no other endpoints in the tier are available.
+		candidates = slices.DeleteFunc(candidates, func(c candidate) bool {
+			return c.weight == 0
+		})
+	}
+	for i := range candidates {
+		candidates[i].weight *= lb.slowStartFactorLocked(candidates[i].endpoint, now)
+	}
+
+	c := candidates[lb.algorithm.choose(candidates, opts)]
+	lb.acquireLocked(c.addr)
+	lb.queue.Rotate(c.index + 1)
+	return c.addr, nil
+}
+
+// slowStartMinFactor is the fraction of its weight that an address receives
+// at the beginning of its slow start period.
+const slowStartMinFactor = 0.1
+
+// slowStartFactorLocked returns the fraction of its weight
+// that the endpoint should currently receive.
+// lb.mu must be held.
+func (lb *loadBalancer) slowStartFactorLocked(e *endpoint, now time.Time) float64 {
+	if lb.slowStart <= 0 {
+		return 1
+	}
+	since := e.since
+	if st := lb.outliers[e.addr]; st != nil && st.ejectedUntil.After(since) {
+		since = st.ejectedUntil
+	}
+	if since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= lb.slowStart {
+		return 1
+	}
+	return max(float64(elapsed)/float64(lb.slowStart), slowStartMinFactor)
 }
 
-// refresh updates the addresses in the queue.
+// acquireLocked records an in-flight use of addr.
+// lb.mu must be held.
+func (lb *loadBalancer) acquireLocked(addr netip.AddrPort) {
+	if lb.active == nil {
+		lb.active = make(map[netip.AddrPort]int)
+	}
+	lb.active[addr]++
+}
+
+// release informs the load balancer that the caller has finished
+// using an address returned by pick.
+// Every successful call to pick must be paired with a call to release.
+func (lb *loadBalancer) release(ctx context.Context, addr netip.AddrPort) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	switch n := lb.active[addr]; {
+	case n > 1:
+		lb.active[addr] = n - 1
+	case n == 1:
+		delete(lb.active, addr)
+	default:
+		// Keep the count from going negative
+		// so that one unpaired release doesn't skew balancing.
+		log.Errorf(ctx, "Released %v more times than it was picked", addr)
+	}
+}
+
+// isAvailableLocked reports whether the address is eligible to receive traffic.
+// The caller must be holding onto lb.mu.
+func (lb *loadBalancer) isAvailableLocked(addr netip.AddrPort, now time.Time) bool {
+	_, unhealthy := lb.unhealthy[addr]
+	return !unhealthy && !lb.isEjectedLocked(addr, now)
+}
+
+// observeLatency records the time it took for an address to respond
+// for use by the [ewma] algorithm.
+func (lb *loadBalancer) observeLatency(addr netip.AddrPort, d time.Duration) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for i, n := 0, lb.queue.Len(); i < n; i++ {
+		if e := lb.queue.At(i); e.addr == addr {
+			e.observe(lb.now(), d)
+			return
+		}
+	}
+}
+
+// addresses returns the current set of resolved addresses,
+// including unhealthy and ejected ones.
+func (lb *loadBalancer) addresses(ctx context.Context) ([]netip.AddrPort, error) {
+	if err := lb.ensureResolved(ctx); err != nil {
+		return nil, err
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	addrs := make([]netip.AddrPort, 0, lb.queue.Len())
+	for i, n := 0, lb.queue.Len(); i < n; i++ {
+		addrs = append(addrs, lb.queue.At(i).addr)
+	}
+	return addrs, nil
+}
+
+// setHealthy marks the address as healthy or unhealthy.
+// Unhealthy addresses will not be returned by pick.
+func (lb *loadBalancer) setHealthy(addr netip.AddrPort, healthy bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if healthy {
+		if _, wasUnhealthy := lb.unhealthy[addr]; !wasUnhealthy {
+			return
+		}
+		delete(lb.unhealthy, addr)
+		for i, n := 0, lb.queue.Len(); i < n; i++ {
+			if e := lb.queue.At(i); e.addr == addr {
+				e.since = lb.now()
+				break
+			}
+		}
+		return
+	}
+	if lb.unhealthy == nil {
+		lb.unhealthy = make(map[netip.AddrPort]struct{})
+	}
+	lb.unhealthy[addr] = struct{}{}
+}
+
+// resolution is the cached result of resolving a single backend.
+type resolution struct {
+	endpoints []endpoint
+	// expires is the time at which the backend should be resolved again.
+	// The zero value means the backend never needs to be resolved again.
+	expires time.Time
+}
+
+// run refreshes the load balancer's addresses in the background
+// as their DNS records expire.
+// It returns once ctx is canceled.
+func (lb *loadBalancer) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			log.Debugf(ctx, "Stopping DNS refresh: %v", ctx.Err())
+			return
+		}
+		next, err := lb.refresh(ctx)
+		if err != nil {
+			log.Debugf(ctx, "Stopping DNS refresh: %v", err)
+			return
+		}
+		if next.IsZero() {
+			// No backends require DNS resolution.
+			return
+		}
+		timer.Reset(next.Sub(lb.now()))
+	}
+}
+
+// ensureResolved resolves the backends
+// if they have not been resolved at least once.
+func (lb *loadBalancer) ensureResolved(ctx context.Context) error {
+	lb.mu.Lock()
+	resolved := lb.resolved
+	lb.mu.Unlock()
+	if resolved {
+		return nil
+	}
+	_, err := lb.refresh(ctx)
+	return err
+}
+
+// refresh resolves any backends whose DNS records have expired
+// and updates the addresses in the queue.
+// If resolving a backend fails,
+// then its previously resolved addresses continue to be used.
+// refresh returns the time at which it should next be called
+// or the zero time if none of the backends require DNS resolution.
 // It only returns errors if the Context is canceled or exceeds its deadline
 // before the DNS resolution is complete.
-func (lb *loadBalancer) refresh(ctx context.Context) error {
+func (lb *loadBalancer) refresh(ctx context.Context) (next time.Time, err error) {
 	// Only allow one refresh call at a time.
 	select {
 	case lb.refreshSem <- struct{}{}:
 		// Release the semaphore on return.
 		defer func() { <-lb.refreshSem }()
 	case <-ctx.Done():
-		return fmt.Errorf("refresh backends: start: %w", ctx.Err())
+		return time.Time{}, fmt.Errorf("refresh backends: start: %w", ctx.Err())
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	grp, grpCtx := errgroup.WithContext(ctx)
-	grp.SetLimit(10)
-	addrChan := make(chan netip.AddrPort)
-	addrSetChan := make(chan map[netip.AddrPort]struct{}, 1)
-	defer func() {
-		cancel()
-		if err := grp.Wait(); err != nil {
-			log.Debugf(ctx, "Load balance refresh abort: %v", err)
-		}
-		<-addrSetChan
-	}()
-
-	go func() {
-		defer close(addrSetChan)
-		addrs := make(map[netip.AddrPort]struct{})
-		for {
-			select {
-			case a, ok := <-addrChan:
-				if !ok {
-					addrSetChan <- addrs
-					return
-				}
-				addrs[a] = struct{}{}
-			case <-ctx.Done():
-				return
+	if lb.resolutions == nil {
+		lb.resolutions = make([]resolution, len(lb.backends))
+		for i, b := range lb.backends {
+			if b.addr.IsValid() {
+				lb.resolutions[i].endpoints = []endpoint{{
+					addr:   netip.AddrPortFrom(b.addr, b.port),
+					weight: max(b.weight, 1),
+				}}
 			}
 		}
-	}()
+	}
 
 	// Start the name resolution.
-	const maxConcurrency = 10
-	goFunc := func(ctx context.Context, f func() error) error {
-		grp.Go(f)
-		return nil
+	start := lb.now()
+	type lookupResult struct {
+		endpoints []endpoint
+		ttl       time.Duration
+		err       error
 	}
-	for _, b := range lb.backends {
-		if b.addr.IsValid() {
-			addrChan <- netip.AddrPortFrom(b.addr, b.port)
+	results := make([]*lookupResult, len(lb.backends))
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.SetLimit(10)
+	for i, b := range lb.backends {
+		if b.addr.IsValid() || start.Before(lb.resolutions[i].expires) {
 			continue
 		}
-
-		b := b
-		err := goFunc(ctx, func() error {
-			return lookup(grpCtx, addrChan, lb.resolver, goFunc, b)
+		i, b := i, b
+		results[i] = new(lookupResult)
+		grp.Go(func() error {
+			rec := new(ttlRecorder)
+			endpoints, err := lookup(withTTLRecorder(grpCtx, rec), lb.resolver, b)
+			results[i].endpoints = endpoints
+			results[i].err = err
+			var ok bool
+			results[i].ttl, ok = rec.min()
+			if !ok {
+				results[i].ttl = lb.minTTL
+			}
+			return nil
 		})
-		if err != nil {
-			return fmt.Errorf("refresh backends: %w", err)
-		}
 	}
-
-	// Wait until all workers have settled, then collect the set.
-	if err := grp.Wait(); err != nil {
-		return fmt.Errorf("refresh backends: %w", err)
+	grp.Wait()
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("refresh backends: %w", err)
 	}
-	close(addrChan)
-	var addrSet map[netip.AddrPort]struct{}
-	select {
-	case addrSet = <-addrSetChan:
-	case <-ctx.Done():
-		return fmt.Errorf("refresh backends: %w", ctx.Err())
+
+	// Collect the addresses.
+	// If an address is present in multiple backends,
+	// use its most preferred tier and combine the weights within that tier.
+	addrSet := make(map[netip.AddrPort]endpoint)
+	for i, b := range lb.backends {
+		res := &lb.resolutions[i]
+		if r := results[i]; r != nil {
+			if r.err != nil {
+				log.Warnf(ctx, "Resolve %v (using last known addresses): %v", b, r.err)
+				res.expires = start.Add(lb.minTTL)
+			} else {
+				res.endpoints = r.endpoints
+				res.expires = start.Add(min(max(r.ttl, lb.minTTL), lb.maxTTL))
+			}
+		}
+		for _, e := range res.endpoints {
+			prev, seen := addrSet[e.addr]
+			switch {
+			case !seen || e.tier < prev.tier:
+				addrSet[e.addr] = e
+			case e.tier == prev.tier:
+				prev.weight += e.weight
+				addrSet[e.addr] = prev
+			}
+		}
+		if !res.expires.IsZero() && (next.IsZero() || res.expires.Before(next)) {
+			next = res.expires
+		}
 	}
 
 	// Update the queue.
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	lb.queue.Filter(func(a netip.AddrPort) bool { _, ok := addrSet[a]; return ok })
+	initial := !lb.resolved
+	lb.resolved = true
+	lb.queue.Filter(func(e *endpoint) bool { _, ok := addrSet[e.addr]; return ok })
+	for a := range lb.unhealthy {
+		if _, ok := addrSet[a]; !ok {
+			delete(lb.unhealthy, a)
+		}
+	}
+	for a := range lb.outliers {
+		if _, ok := addrSet[a]; !ok {
+			delete(lb.outliers, a)
+		}
+	}
 	for i, n := 0, lb.queue.Len(); i < n; i++ {
-		delete(addrSet, lb.queue.At(i))
+		e := lb.queue.At(i)
+		newEndpoint := addrSet[e.addr]
+		e.tier = newEndpoint.tier
+		e.weight = newEndpoint.weight
+		delete(addrSet, e.addr)
 	}
-	for newAddr := range addrSet {
-		lb.queue.Append(newAddr)
+	for _, newEndpoint := range addrSet {
+		e := new(endpoint)
+		*e = newEndpoint
+		if !initial {
+			e.since = start
+		}
+		lb.queue.Append(e)
 	}
-	return nil
+	return next, nil
 }
 
-func lookup(ctx context.Context, out chan<- netip.AddrPort, resolver resolver, goFunc func(context.Context, func() error) error, b *backend) error {
-	if b.srv {
-		_, records, err := resolver.LookupSRV(ctx, "", "", b.hostname)
-		if err != nil {
-			log.Warnf(ctx, "%v", err)
-			return nil
-		}
-		if log.IsEnabled(log.Debug) {
-			recordsString := new(strings.Builder)
-			for i, r := range records {
-				if i > 0 {
-					recordsString.WriteString(" ")
-				}
-				fmt.Fprintf(recordsString, "%s:%d", r.Target, r.Port)
-			}
-			log.Debugf(ctx, "Resolved SRV %s -> %s", b.hostname, recordsString)
-		}
-		if len(records) == 0 {
-			log.Warnf(ctx, "No SRV records found for %s", b.hostname)
-			return nil
-		}
-		for _, r := range records[:len(records)-1] {
-			r := r
-			err := goFunc(ctx, func() error {
-				return lookup(ctx, out, resolver, goFunc, &backend{
-					hostname: r.Target,
-					port:     r.Port,
-				})
-			})
-			if err != nil {
-				return err
+// lookup resolves the endpoints for a backend.
+// A name that does not exist is not considered an error:
+// it just has no addresses.
+func lookup(ctx context.Context, resolver resolver, b *backend) ([]endpoint, error) {
+	weight := max(b.weight, 1)
+	if !b.srv {
+		return lookupHost(ctx, resolver, b.hostname, b.port, 0, weight)
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", b.hostname)
+	if isNotFound(err) {
+		log.Warnf(ctx, "%v", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if log.IsEnabled(log.Debug) {
+		recordsString := new(strings.Builder)
+		for i, r := range records {
+			if i > 0 {
+				recordsString.WriteString(" ")
 			}
+			fmt.Fprintf(recordsString, "%s:%d(priority=%d,weight=%d)", r.Target, r.Port, r.Priority, r.Weight)
 		}
+		log.Debugf(ctx, "Resolved SRV %s -> %s", b.hostname, recordsString)
+	}
+	if len(records) == 0 {
+		log.Warnf(ctx, "No SRV records found for %s", b.hostname)
+		return nil, nil
+	}
 
-		// Don't acquire the semaphore for the last record:
-		// just reuse the one already grabbed for this goroutine.
-		lastRecord := records[len(records)-1]
-		b = &backend{
-			hostname: lastRecord.Target,
-			port:     lastRecord.Port,
+	// Convert priorities into tiers relative to this set of records,
+	// so that the most preferred records share a tier with other backends.
+	slices.SortStableFunc(records, func(r1, r2 *net.SRV) int {
+		return cmp.Compare(r1.Priority, r2.Priority)
+	})
+	tiers := make([]int, len(records))
+	for i := 1; i < len(records); i++ {
+		tiers[i] = tiers[i-1]
+		if records[i].Priority != records[i-1].Priority {
+			tiers[i]++
 		}
 	}
 
-	addrs, err := resolver.LookupNetIP(ctx, "ip", b.hostname)
-	if err != nil {
+	targetEndpoints := make([][]endpoint, len(records))
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.SetLimit(10)
+	for i, r := range records {
+		i, r := i, r
+		grp.Go(func() error {
+			var err error
+			targetEndpoints[i], err = lookupHost(grpCtx, resolver, r.Target, r.Port, tiers[i], int(r.Weight)*weight)
+			return err
+		})
+	}
+	if err := grp.Wait(); err != nil {
+		return nil, err
+	}
+	var endpoints []endpoint
+	for _, te := range targetEndpoints {
+		endpoints = append(endpoints, te...)
+	}
+	return endpoints, nil
+}
+
+func lookupHost(ctx context.Context, resolver resolver, host string, port uint16, tier, weight int) ([]endpoint, error) {
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if isNotFound(err) {
 		log.Warnf(ctx, "%v", err)
-		return nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 	// Workaround for upstream Go weirdness: https://go.dev/issue/53554
 	// LookupNetIP can return IPv4-mapped IPv6 addresses,
@@ -220,14 +594,21 @@ func lookup(ctx context.Context, out chan<- netip.AddrPort, resolver resolver, g
 			}
 			addrsString.WriteString(a.String())
 		}
-		log.Debugf(ctx, "Resolved A/AAAA %s -> %s", b.hostname, addrsString)
+		log.Debugf(ctx, "Resolved A/AAAA %s -> %s", host, addrsString)
 	}
+	endpoints := make([]endpoint, 0, len(addrs))
 	for _, a := range addrs {
-		select {
-		case out <- netip.AddrPortFrom(a, b.port):
-		case <-ctx.Done():
-			return ctx.Err()
-		}
+		endpoints = append(endpoints, endpoint{
+			addr:   netip.AddrPortFrom(a, port),
+			tier:   tier,
+			weight: weight,
+		})
 	}
-	return nil
+	return endpoints, nil
+}
+
+// isNotFound reports whether err indicates that a DNS name does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
 }
@@ -18,11 +18,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"zombiezen.com/go/log/testlog"
@@ -168,26 +170,326 @@ func TestSRV(t *testing.T) {
 		}
 		got[addrPort] = struct{}{}
 	}
+	// Only the lowest priority should be used while it's available.
 	want := map[netip.AddrPort]struct{}{
-		netip.MustParseAddrPort("192.0.2.1:80"):   {},
-		netip.MustParseAddrPort("192.0.2.2:80"):   {},
+		netip.MustParseAddrPort("192.0.2.1:80"): {},
+		netip.MustParseAddrPort("192.0.2.2:80"): {},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("picked (-want +got):\n%s", diff)
+	}
+
+	// Once the lowest priority is unavailable,
+	// the load balancer should fall back to the next priority.
+	lb.setHealthy(netip.MustParseAddrPort("192.0.2.1:80"), false)
+	lb.setHealthy(netip.MustParseAddrPort("192.0.2.2:80"), false)
+	want = map[netip.AddrPort]struct{}{
 		netip.MustParseAddrPort("192.0.2.1:8080"): {},
 		netip.MustParseAddrPort("192.0.2.2:8080"): {},
 	}
+	if diff := cmp.Diff(want, pickSet(ctx, t, lb, 4)); diff != "" {
+		t.Errorf("after marking priority 10 unhealthy, picked (-want +got):\n%s", diff)
+	}
+}
+
+func TestSRVWeight(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	rslv := fakeResolver{
+		a: map[string][]netip.Addr{
+			"big.example.com.":   {netip.MustParseAddr("192.0.2.1")},
+			"small.example.com.": {netip.MustParseAddr("192.0.2.2")},
+			"zero.example.com.":  {netip.MustParseAddr("192.0.2.3")},
+		},
+		srv: map[string][]*net.SRV{
+			"_http._tcp.example.com": {
+				{Target: "big.example.com.", Port: 80, Priority: 10, Weight: 30},
+				{Target: "small.example.com.", Port: 80, Priority: 10, Weight: 10},
+				{Target: "zero.example.com.", Port: 80, Priority: 10, Weight: 0},
+			},
+		},
+	}
+	lb := newLoadBalancer(rslv, []*backend{
+		{hostname: "_http._tcp.example.com", srv: true},
+	})
+
+	got := make(map[netip.AddrPort]int)
+	for i := 0; i < 8; i++ {
+		addrPort, err := lb.pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[addrPort]++
+	}
+	want := map[netip.AddrPort]int{
+		netip.MustParseAddrPort("192.0.2.1:80"): 6,
+		netip.MustParseAddrPort("192.0.2.2:80"): 2,
+	}
 	if diff := cmp.Diff(want, got); diff != "" {
-		t.Errorf("picked (-want +got):\n%s", diff)
+		t.Errorf("pick counts (-want +got):\n%s", diff)
+	}
+
+	// Zero-weight targets are only used when no others are available.
+	lb.setHealthy(netip.MustParseAddrPort("192.0.2.1:80"), false)
+	lb.setHealthy(netip.MustParseAddrPort("192.0.2.2:80"), false)
+	wantAddr := netip.MustParseAddrPort("192.0.2.3:80")
+	if got, err := lb.pick(ctx); got != wantAddr || err != nil {
+		t.Errorf("lb.pick(ctx) = %v, %v; want %v, <nil>", got, err, wantAddr)
+	}
+}
+
+func TestBackendWeight(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	rslv := fakeResolver{a: map[string][]netip.Addr{
+		"big.example.com": {
+			netip.MustParseAddr("192.0.2.1"),
+			netip.MustParseAddr("192.0.2.2"),
+		},
+	}}
+	lb := newLoadBalancer(rslv, []*backend{
+		{hostname: "big.example.com", port: 80, weight: 3},
+		{addr: netip.MustParseAddr("192.0.2.3"), port: 80, weight: 2},
+	})
+
+	got := make(map[netip.AddrPort]int)
+	for i := 0; i < 16; i++ {
+		addrPort, err := lb.pick(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[addrPort]++
+	}
+	want := map[netip.AddrPort]int{
+		netip.MustParseAddrPort("192.0.2.1:80"): 6,
+		netip.MustParseAddrPort("192.0.2.2:80"): 6,
+		netip.MustParseAddrPort("192.0.2.3:80"): 4,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("pick counts (-want +got):\n%s", diff)
 	}
 }
 
+func TestDNSCache(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	rslv := &fakeResolver{
+		a: map[string][]netip.Addr{
+			"example.com": {netip.MustParseAddr("192.0.2.1")},
+		},
+		ttl: time.Minute,
+	}
+	lb := newLoadBalancer(rslv, []*backend{
+		{hostname: "example.com", port: 80},
+	})
+	lb.minTTL = 5 * time.Second
+	lb.maxTTL = 5 * time.Minute
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+
+	next, err := lb.refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(time.Minute); !next.Equal(want) {
+		t.Errorf("lb.refresh(ctx) = %v, <nil>; want %v, <nil>", next, want)
+	}
+	want1 := addrSet(netip.MustParseAddrPort("192.0.2.1:80"))
+	if diff := cmp.Diff(want1, pickSet(ctx, t, lb, 2)); diff != "" {
+		t.Errorf("after first refresh, picked (-want +got):\n%s", diff)
+	}
+
+	// Before the TTL expires, changes in DNS should not be observed.
+	rslv.a["example.com"] = []netip.Addr{netip.MustParseAddr("192.0.2.2")}
+	now = now.Add(30 * time.Second)
+	if _, err := lb.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want1, pickSet(ctx, t, lb, 2)); diff != "" {
+		t.Errorf("before TTL expiry, picked (-want +got):\n%s", diff)
+	}
+
+	// Once the TTL expires, the new records should be used.
+	// The TTL should be clamped to the maximum.
+	rslv.ttl = time.Hour
+	now = now.Add(30 * time.Second)
+	next, err = lb.refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(5 * time.Minute); !next.Equal(want) {
+		t.Errorf("lb.refresh(ctx) = %v, <nil>; want %v, <nil>", next, want)
+	}
+	want2 := addrSet(netip.MustParseAddrPort("192.0.2.2:80"))
+	if diff := cmp.Diff(want2, pickSet(ctx, t, lb, 2)); diff != "" {
+		t.Errorf("after TTL expiry, picked (-want +got):\n%s", diff)
+	}
+
+	// If DNS fails, then the last known addresses should be used
+	// and resolution should be retried after the minimum TTL.
+	rslv.err = errors.New("bork")
+	now = now.Add(5 * time.Minute)
+	next, err = lb.refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(5 * time.Second); !next.Equal(want) {
+		t.Errorf("lb.refresh(ctx) = %v, <nil>; want %v, <nil>", next, want)
+	}
+	if diff := cmp.Diff(want2, pickSet(ctx, t, lb, 2)); diff != "" {
+		t.Errorf("after DNS failure, picked (-want +got):\n%s", diff)
+	}
+
+	// Names that no longer exist should be removed.
+	rslv.err = &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}
+	now = now.Add(5 * time.Second)
+	if _, err := lb.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lb.pick(ctx); err == nil {
+		t.Errorf("after NXDOMAIN, lb.pick(ctx) = %v, <nil>; want error", got)
+	}
+}
+
+func TestPickExclude(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: netip.MustParseAddr("127.0.0.1"), port: 80},
+		{addr: netip.MustParseAddr("127.0.0.1"), port: 81},
+	})
+	opts := &pickOptions{
+		exclude: map[netip.AddrPort]struct{}{
+			netip.MustParseAddrPort("127.0.0.1:80"): {},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		got, err := lb.pickWithOptions(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := netip.MustParseAddrPort("127.0.0.1:81"); got != want {
+			t.Errorf("lb.pickWithOptions(ctx, opts) = %v; want %v", got, want)
+		}
+	}
+
+	opts.exclude[netip.MustParseAddrPort("127.0.0.1:81")] = struct{}{}
+	if got, err := lb.pickWithOptions(ctx, opts); err == nil {
+		t.Errorf("lb.pickWithOptions(ctx, opts) with all addresses excluded = %v, <nil>; want error", got)
+	}
+}
+
+func TestReleaseUnpaired(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: netip.MustParseAddr("127.0.0.1"), port: 80},
+	})
+	addr, err := lb.pick(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.release(ctx, addr)
+	// An extra release must not panic or leave a negative count.
+	lb.release(ctx, addr)
+	if n := lb.active[addr]; n != 0 {
+		t.Errorf("after extra release, active[%v] = %d; want 0", addr, n)
+	}
+
+	if _, err := lb.pick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := lb.active[addr]; n != 1 {
+		t.Errorf("after pick, active[%v] = %d; want 1", addr, n)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	warm := netip.MustParseAddrPort("192.0.2.1:80")
+	cold := netip.MustParseAddrPort("192.0.2.2:80")
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: warm.Addr(), port: warm.Port(), weight: 1},
+		{addr: cold.Addr(), port: cold.Port(), weight: 1},
+	})
+	lb.slowStart = 10 * time.Second
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+	if _, err := lb.addresses(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lb.setHealthy(cold, false)
+	lb.setHealthy(cold, true)
+
+	tests := []struct {
+		elapsed  time.Duration
+		wantCold int // out of 100 picks
+	}{
+		{0, 9},                 // 0.1 / 1.1
+		{5 * time.Second, 33},  // 0.5 / 1.5
+		{10 * time.Second, 50}, // 1 / 2
+		{time.Minute, 50},
+	}
+	start := now
+	for _, test := range tests {
+		now = start.Add(test.elapsed)
+		got := 0
+		for i := 0; i < 100; i++ {
+			addr, err := lb.pick(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb.release(ctx, addr)
+			if addr == cold {
+				got++
+			}
+		}
+		if got < test.wantCold-2 || got > test.wantCold+2 {
+			t.Errorf("%v after recovery, %v picked %d/100 times; want about %d", test.elapsed, cold, got, test.wantCold)
+		}
+	}
+}
+
+// pickSet calls lb.pick n times and returns the set of addresses returned.
+func pickSet(ctx context.Context, tb testing.TB, lb *loadBalancer, n int) map[netip.AddrPort]struct{} {
+	tb.Helper()
+	got := make(map[netip.AddrPort]struct{})
+	for i := 0; i < n; i++ {
+		addrPort, err := lb.pick(ctx)
+		if err != nil {
+			tb.Error(err)
+			break
+		}
+		lb.release(ctx, addrPort)
+		got[addrPort] = struct{}{}
+	}
+	return got
+}
+
+func addrSet(addrs ...netip.AddrPort) map[netip.AddrPort]struct{} {
+	m := make(map[netip.AddrPort]struct{}, len(addrs))
+	for _, a := range addrs {
+		m[a] = struct{}{}
+	}
+	return m
+}
+
 type fakeResolver struct {
 	a   map[string][]netip.Addr
 	srv map[string][]*net.SRV
+
+	// ttl is the TTL reported for every lookup.
+	// If zero, then no TTL is reported.
+	ttl time.Duration
+	// err is returned from every lookup if not nil.
+	err error
 }
 
 func (r fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
 	if network != "ip" {
 		return nil, fmt.Errorf("lookup ip: only \"ip\" network supported (got %q)", network)
 	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if rec := ttlRecorderFromContext(ctx); rec != nil && r.ttl > 0 {
+		rec.record(r.ttl)
+	}
 	return append([]netip.Addr(nil), r.a[host]...), nil
 }
 
@@ -197,6 +499,12 @@ func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string
 	} else {
 		cname = name
 	}
+	if r.err != nil {
+		return cname, nil, r.err
+	}
+	if rec := ttlRecorderFromContext(ctx); rec != nil && r.ttl > 0 {
+		rec.record(r.ttl)
+	}
 	records := r.srv[cname]
 	if len(records) == 0 {
 		return cname, nil, nil
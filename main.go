@@ -25,6 +25,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -35,6 +36,7 @@ import (
 
 	"golang.org/x/sync/errgroup"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store"
 	"tailscale.com/ipn/store/mem"
@@ -50,6 +52,14 @@ const programName = "tailscale-lb"
 
 const tailscaleLogLevel = log.Debug - 1
 
+// tlsHandshakeTimeout is the maximum amount of time
+// to wait for a client to complete a TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// whoisTimeout is the maximum amount of time
+// to wait for Tailscale to identify a client connection.
+const whoisTimeout = 10 * time.Second
+
 func main() {
 	flagSet := flag.NewFlagSet(programName, flag.ContinueOnError)
 	flagSet.Usage = func() {
@@ -179,7 +189,7 @@ func run(ctx context.Context, cfg *configuration) error {
 		logStartupInfo(ctx, client)
 	}()
 
-	systemResolver := new(net.Resolver)
+	systemResolver := newSystemResolver()
 	for port, pc := range cfg.ports {
 		pc := pc
 		log.Infof(ctx, "Listening for TCP port %d", port)
@@ -189,26 +199,53 @@ func run(ctx context.Context, cfg *configuration) error {
 		}
 		switch {
 		case pc.tcp != nil:
-			lb := newLoadBalancer(systemResolver, pc.tcp.backends)
+			if pc.tcp.tls {
+				l = tls.NewListener(l, &tls.Config{
+					GetCertificate: client.GetCertificate,
+					NextProtos:     pc.tcp.alpn,
+				})
+			}
+			tlb := newTCPLoadBalancer(ctx, &wg, systemResolver, client, pc.tcp)
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				listenTCPPort(ctx, l, lb)
+				listenTCPPort(ctx, l, func(ctx context.Context, conn net.Conn) {
+					handleTCPConn(ctx, conn, tlb)
+				})
+			}()
+		case pc.tls != nil:
+			router := &tlsRouter{
+				routes: make(map[string]*tcpLoadBalancer),
+			}
+			if pc.tls.defaultRoute != nil {
+				router.defaultRoute = newTCPLoadBalancer(ctx, &wg, systemResolver, client, pc.tls.defaultRoute)
+			}
+			for serverName, tc := range pc.tls.routes {
+				tlb := newTCPLoadBalancer(ctx, &wg, systemResolver, client, tc)
+				if pc.tls.access != nil {
+					tlb.access = append([]*accessPolicy{pc.tls.access}, tlb.access...)
+				}
+				router.routes[serverName] = tlb
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				listenTCPPort(ctx, l, func(ctx context.Context, conn net.Conn) {
+					handleTLSConn(ctx, conn, router)
+				})
 			}()
 		case pc.http != nil:
+			router, hlbs := newHTTPRouter(ctx, &wg, systemResolver, client, pc.http)
 			httpServer := &http.Server{
-				Handler: &httpLoadBalancer{
-					lb:        newLoadBalancer(systemResolver, pc.http.backends),
-					tailscale: client,
-					trustXFF:  pc.http.trustXFF,
-				},
+				Handler:     router,
+				Protocols:   serverProtocols(),
 				BaseContext: func(net.Listener) context.Context { return ctx },
 				ErrorLog: zstdlog.New(log.Default(), &zstdlog.Options{
 					Context: ctx,
 					Level:   log.Error,
 				}),
-				ReadTimeout:  5 * time.Second,
-				WriteTimeout: 5 * time.Second,
+				ReadHeaderTimeout: pc.http.readHeaderTimeout,
+				IdleTimeout:       pc.http.idleTimeout,
 			}
 			if pc.http.tls {
 				httpServer.TLSConfig = &tls.Config{
@@ -220,6 +257,11 @@ func run(ctx context.Context, cfg *configuration) error {
 				defer wg.Done()
 				<-ctx.Done()
 				httpServer.Shutdown(context.Background())
+				// Upgraded connections are closed when ctx is done,
+				// but the server doesn't track them.
+				for _, hlb := range hlbs {
+					hlb.upgrades.Wait()
+				}
 			}()
 			go func() {
 				defer wg.Done()
@@ -233,10 +275,146 @@ func run(ctx context.Context, cfg *configuration) error {
 			panic("unreachable")
 		}
 	}
+	if len(cfg.udpPorts) > 0 {
+		// ListenPacket requires an IP address,
+		// so wait until the node has its Tailscale addresses.
+		status, err := srv.Up(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for port, uc := range cfg.udpPorts {
+			ulb := &udpLoadBalancer{
+				lb:          startPool(ctx, &wg, systemResolver, &uc.poolConfig),
+				tailscale:   client,
+				hashKey:     uc.hashKey,
+				idleTimeout: uc.idleTimeout,
+				maxFlows:    uc.maxFlows,
+			}
+			for _, ip := range status.TailscaleIPs {
+				log.Infof(ctx, "Listening for UDP port %d on %v", port, ip)
+				conn, err := srv.ListenPacket("udp", netip.AddrPortFrom(ip, port).String())
+				if err != nil {
+					return err
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					serveUDP(ctx, conn, ulb)
+				}()
+			}
+		}
+	}
 	<-ctx.Done()
 	return nil
 }
 
+// startPool creates a load balancer for the given pool
+// and starts its background DNS resolution and health checks.
+// The background goroutines stop once ctx is canceled.
+func startPool(ctx context.Context, wg *sync.WaitGroup, r resolver, pool *poolConfig) *loadBalancer {
+	lb := newLoadBalancer(r, pool.backends)
+	lb.minTTL = pool.minDNSTTL
+	lb.maxTTL = pool.maxDNSTTL
+	lb.algorithm = balancingAlgorithms[pool.algorithm]()
+	lb.slowStart = pool.slowStart
+	lb.outlierDetection = pool.outlierDetection
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lb.run(ctx)
+	}()
+	if pool.healthCheck != nil {
+		hc := newHealthChecker(lb, pool.healthCheck, newHealthProbe(pool.healthCheck))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.run(ctx)
+		}()
+	}
+	return lb
+}
+
+// newHealthProbe returns the probe to use for a pool's active health checks.
+func newHealthProbe(cfg *healthCheckConfig) probeFunc {
+	if cfg.http == nil {
+		return tcpProbe
+	}
+	return httpProbe(cfg.http, &http.Transport{
+		TLSClientConfig:   cfg.http.tls.Clone(),
+		Protocols:         backendProtocols(cfg.http.protocol),
+		DisableKeepAlives: true,
+	})
+}
+
+// newTCPLoadBalancer starts a pool for the given configuration
+// and returns a load balancer for forwarding TCP connections to it.
+func newTCPLoadBalancer(ctx context.Context, wg *sync.WaitGroup, r resolver, client *tailscale.LocalClient, tc *tcpConfig) *tcpLoadBalancer {
+	tlb := &tcpLoadBalancer{
+		lb:             startPool(ctx, wg, r, &tc.poolConfig),
+		tailscale:      client,
+		hashKey:        tc.hashKey,
+		retries:        tc.retries,
+		connectTimeout: tc.connectTimeout,
+		proxyProtocol:  tc.proxyProtocol,
+	}
+	if tc.access != nil {
+		tlb.access = []*accessPolicy{tc.access}
+	}
+	return tlb
+}
+
+// newHTTPRouter starts pools for the given http section's backends and routes.
+// It returns the router along with the load balancers it forwards to.
+func newHTTPRouter(ctx context.Context, wg *sync.WaitGroup, r resolver, client *tailscale.LocalClient, hc *httpConfig) (*httpRouter, []*httpLoadBalancer) {
+	router := &httpRouter{
+		access:    hc.access,
+		tailscale: client,
+	}
+	var hlbs []*httpLoadBalancer
+	if len(hc.backends) > 0 || len(hc.routes) == 0 {
+		hlb := newHTTPLoadBalancer(ctx, wg, r, client, hc, &hc.httpBackendConfig)
+		router.defaultRoute = hlb
+		hlbs = append(hlbs, hlb)
+	}
+	for name, rc := range hc.routes {
+		// The router checks the section's policy before routing.
+		hlb := newHTTPLoadBalancer(ctx, wg, r, client, hc, &rc.httpBackendConfig)
+		if rc.access != nil {
+			hlb.access = []*accessPolicy{rc.access}
+		}
+		router.routes = append(router.routes, newHTTPRoute(name, rc, hlb))
+		hlbs = append(hlbs, hlb)
+	}
+	sortHTTPRoutes(router.routes)
+	return router, hlbs
+}
+
+// newHTTPLoadBalancer starts a pool for the given backend configuration
+// and returns a load balancer for forwarding requests to it.
+func newHTTPLoadBalancer(ctx context.Context, wg *sync.WaitGroup, r resolver, client *tailscale.LocalClient, hc *httpConfig, bc *httpBackendConfig) *httpLoadBalancer {
+	hlb := &httpLoadBalancer{
+		lb:              startPool(ctx, wg, r, &bc.poolConfig),
+		tailscale:       client,
+		whoisHeaders:    hc.whois,
+		trustXFF:        hc.trustXFF,
+		hashKey:         bc.hashKey,
+		backendTLS:      bc.backendTLS != nil,
+		streamTimeout:   hc.streamTimeout,
+		appCapabilities: hc.appCapabilities,
+	}
+	if bc.stickyCookie != "" {
+		hlb.sticky = newStickyCookie(bc.stickyCookie, bc.stickyKey, hc.tls)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = bc.backendTLS.Clone()
+	transport.Protocols = backendProtocols(bc.backendProtocol)
+	hlb.transport = transport
+	return hlb
+}
+
 func logStartupInfo(ctx context.Context, client *tailscale.LocalClient) {
 	tick := time.NewTicker(2 * time.Second)
 	defer tick.Stop()
@@ -278,7 +456,11 @@ func logStartupInfo(ctx context.Context, client *tailscale.LocalClient) {
 	}
 }
 
-func listenTCPPort(ctx context.Context, l net.Listener, lb *loadBalancer) {
+// listenTCPPort accepts connections from l and calls handle
+// in a new goroutine for each one
+// until ctx is canceled or l is closed.
+// handle is responsible for closing the connection.
+func listenTCPPort(ctx context.Context, l net.Listener, handle func(context.Context, net.Conn)) {
 	var closeOnce sync.Once
 	closeListener := func() {
 		closeOnce.Do(func() {
@@ -313,31 +495,65 @@ func listenTCPPort(ctx context.Context, l net.Listener, lb *loadBalancer) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			handleTCPConn(ctx, conn, lb)
+			handle(ctx, conn)
 		}()
 	}
 }
 
-func handleTCPConn(ctx context.Context, clientConn net.Conn, lb *loadBalancer) {
+func handleTCPConn(ctx context.Context, clientConn net.Conn, tlb *tcpLoadBalancer) {
 	defer func() {
 		if err := clientConn.Close(); err != nil {
 			log.Errorf(ctx, "%v", err)
 		}
 	}()
 
-	pickCtx, cancelPick := context.WithTimeout(ctx, 30*time.Second)
-	backendAddr, err := lb.pick(pickCtx)
-	cancelPick()
-	if err != nil {
-		log.Warnf(ctx, "Unable to find suitable backend for %v on %v: %v", clientConn.RemoteAddr(), clientConn.LocalAddr(), err)
+	whois := sync.OnceValue(func() *apitype.WhoIsResponse {
+		whoisCtx, cancel := context.WithTimeout(ctx, whoisTimeout)
+		defer cancel()
+		whois, err := tlb.tailscale.WhoIs(whoisCtx, clientConn.RemoteAddr().String())
+		if err != nil {
+			log.Warnf(ctx, "Tailscale whois for %v: %v", clientConn.RemoteAddr(), err)
+			return nil
+		}
+		return whois
+	})
+	if len(tlb.access) > 0 && !tlb.checkAccess(ctx, clientConn, whois()) {
 		return
 	}
-	log.Debugf(ctx, "Picked backend %v for %v on %v", backendAddr, clientConn.RemoteAddr(), clientConn.LocalAddr())
-	backendConn, err := new(net.Dialer).DialContext(ctx, "tcp", backendAddr.String())
+
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		// Complete the handshake before connecting to a backend
+		// so that failed handshakes don't count against it.
+		handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			log.Warnf(ctx, "TLS handshake with %v on %v: %v", clientConn.RemoteAddr(), clientConn.LocalAddr(), err)
+			return
+		}
+	}
+
+	backendConn, backendAddr, err := tlb.dialBackend(ctx, clientConn, whois)
 	if err != nil {
 		log.Warnf(ctx, "Connect to backend for %v on %v: %v", clientConn.RemoteAddr(), clientConn.LocalAddr(), err)
 		return
 	}
+	defer tlb.lb.release(ctx, backendAddr)
+	defer backendConn.Close()
+
+	var header []byte
+	switch tlb.proxyProtocol {
+	case proxyProtocolV1:
+		header = appendProxyHeaderV1(nil, clientConn.RemoteAddr(), clientConn.LocalAddr())
+	case proxyProtocolV2:
+		header = appendProxyHeaderV2(nil, clientConn.RemoteAddr(), clientConn.LocalAddr(), whois())
+	}
+	if len(header) > 0 {
+		if _, err := backendConn.Write(header); err != nil {
+			log.Warnf(ctx, "Send PROXY header for %v on %v to %v: %v", clientConn.RemoteAddr(), clientConn.LocalAddr(), backendAddr, err)
+			return
+		}
+	}
 
 	grp, ctx := errgroup.WithContext(ctx)
 	grp.Go(func() error {
@@ -0,0 +1,110 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"zombiezen.com/go/log"
+)
+
+// outlierStatus is the passive health state of a single address.
+type outlierStatus struct {
+	// failures is the number of consecutive failures observed.
+	failures int
+	// ejections is the number of times the address has been ejected
+	// without recovering.
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// report records the outcome of sending traffic to addr.
+// If outlier detection is enabled and addr has failed too many times in a row,
+// then addr is ejected from rotation for a period of time.
+func (lb *loadBalancer) report(ctx context.Context, addr netip.AddrPort, success bool) {
+	od := lb.outlierDetection
+	if od == nil {
+		return
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := lb.now()
+	st := lb.outliers[addr]
+	if success {
+		if st == nil {
+			return
+		}
+		st.failures = 0
+		if !st.ejectedUntil.IsZero() && now.Sub(st.ejectedUntil) >= od.maxEjectionTime {
+			// The address has stayed in rotation long enough
+			// that we can forget about its previous ejections.
+			delete(lb.outliers, addr)
+		}
+		return
+	}
+
+	if st == nil {
+		if lb.outliers == nil {
+			lb.outliers = make(map[netip.AddrPort]*outlierStatus)
+		}
+		st = new(outlierStatus)
+		lb.outliers[addr] = st
+	}
+	if now.Before(st.ejectedUntil) {
+		// Already ejected. Likely a request that was in flight.
+		return
+	}
+	st.failures++
+	if st.failures < od.consecutiveFailures {
+		return
+	}
+
+	numEjected := 0
+	for _, other := range lb.outliers {
+		if now.Before(other.ejectedUntil) {
+			numEjected++
+		}
+	}
+	if (numEjected+1)*100 > od.maxEjectionPercent*lb.queue.Len() {
+		log.Warnf(ctx, "Backend %v failed %d times in a row, but not ejecting because too many backends are already ejected", addr, st.failures)
+		return
+	}
+	st.failures = 0
+	st.ejections++
+	d := ejectionDuration(od, st.ejections)
+	st.ejectedUntil = now.Add(d)
+	log.Warnf(ctx, "Ejecting backend %v for %v after %d consecutive failures", addr, d, od.consecutiveFailures)
+}
+
+// isEjectedLocked reports whether the address is currently ejected.
+// The caller must be holding onto lb.mu.
+func (lb *loadBalancer) isEjectedLocked(addr netip.AddrPort, now time.Time) bool {
+	st := lb.outliers[addr]
+	return st != nil && now.Before(st.ejectedUntil)
+}
+
+// ejectionDuration returns the duration of an address's nth ejection.
+func ejectionDuration(od *outlierDetectionConfig, n int) time.Duration {
+	d := od.baseEjectionTime
+	for i := 1; i < n && d < od.maxEjectionTime; i++ {
+		d *= 2
+	}
+	return min(d, od.maxEjectionTime)
+}
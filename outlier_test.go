@@ -0,0 +1,111 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/log/testlog"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	addr1 := netip.MustParseAddrPort("127.0.0.1:80")
+	addr2 := netip.MustParseAddrPort("127.0.0.1:81")
+	addr3 := netip.MustParseAddrPort("127.0.0.1:82")
+	lb := newLoadBalancer(fakeResolver{}, []*backend{
+		{addr: addr1.Addr(), port: addr1.Port()},
+		{addr: addr2.Addr(), port: addr2.Port()},
+		{addr: addr3.Addr(), port: addr3.Port()},
+	})
+	lb.outlierDetection = &outlierDetectionConfig{
+		consecutiveFailures: 2,
+		baseEjectionTime:    10 * time.Second,
+		maxEjectionTime:     time.Minute,
+		maxEjectionPercent:  50,
+	}
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lb.now = func() time.Time { return now }
+	all := addrSet(addr1, addr2, addr3)
+	if diff := cmp.Diff(all, pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("initially picked (-want +got):\n%s", diff)
+	}
+
+	// A success in between failures should reset the count.
+	lb.report(ctx, addr1, false)
+	lb.report(ctx, addr1, true)
+	lb.report(ctx, addr1, false)
+	if diff := cmp.Diff(all, pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("after non-consecutive failures, picked (-want +got):\n%s", diff)
+	}
+
+	lb.report(ctx, addr1, false)
+	if diff := cmp.Diff(addrSet(addr2, addr3), pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("after consecutive failures, picked (-want +got):\n%s", diff)
+	}
+
+	// Ejecting another address would exceed the maximum ejection percentage.
+	lb.report(ctx, addr2, false)
+	lb.report(ctx, addr2, false)
+	if diff := cmp.Diff(addrSet(addr2, addr3), pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("after failures exceeding max percentage, picked (-want +got):\n%s", diff)
+	}
+	lb.report(ctx, addr2, true)
+
+	now = now.Add(10 * time.Second)
+	if diff := cmp.Diff(all, pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("after ejection time, picked (-want +got):\n%s", diff)
+	}
+
+	// The second ejection should last twice as long.
+	lb.report(ctx, addr1, false)
+	lb.report(ctx, addr1, false)
+	now = now.Add(10 * time.Second)
+	if diff := cmp.Diff(addrSet(addr2, addr3), pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("during second ejection, picked (-want +got):\n%s", diff)
+	}
+	now = now.Add(10 * time.Second)
+	if diff := cmp.Diff(all, pickSet(ctx, t, lb, 6)); diff != "" {
+		t.Errorf("after second ejection, picked (-want +got):\n%s", diff)
+	}
+}
+
+func TestEjectionDuration(t *testing.T) {
+	od := &outlierDetectionConfig{
+		baseEjectionTime: 10 * time.Second,
+		maxEjectionTime:  time.Minute,
+	}
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		if got := ejectionDuration(od, test.n); got != test.want {
+			t.Errorf("ejectionDuration(od, %d) = %v; want %v", test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// PROXY protocol versions.
+// Reference: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	proxyProtocolNone = 0
+	proxyProtocolV1   = 1
+	proxyProtocolV2   = 2
+)
+
+// Custom PROXY protocol v2 TLV types that carry Tailscale identity.
+const (
+	// proxyTLVTailscaleUser is the login name of the connecting Tailscale user.
+	proxyTLVTailscaleUser = 0xe0
+	// proxyTLVTailscaleNode is the MagicDNS name of the connecting Tailscale node.
+	proxyTLVTailscaleNode = 0xe1
+)
+
+// proxyV2Signature is the fixed prefix of every PROXY protocol v2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// appendProxyHeaderV1 appends a human-readable PROXY protocol header
+// for a TCP connection from src to dst.
+func appendProxyHeaderV1(b []byte, src, dst net.Addr) []byte {
+	srcAddr, srcOK := addrPortFromNetAddr(src)
+	dstAddr, dstOK := addrPortFromNetAddr(dst)
+	if !srcOK || !dstOK || srcAddr.Addr().Is4() != dstAddr.Addr().Is4() {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+	family := "TCP6"
+	if srcAddr.Addr().Is4() {
+		family = "TCP4"
+	}
+	return fmt.Appendf(b, "PROXY %s %v %v %d %d\r\n",
+		family, srcAddr.Addr(), dstAddr.Addr(), srcAddr.Port(), dstAddr.Port())
+}
+
+// appendProxyHeaderV2 appends a binary PROXY protocol header
+// for a TCP connection from src to dst.
+// If whois is not nil, then the header includes TLVs
+// with the connecting user and node.
+func appendProxyHeaderV2(b []byte, src, dst net.Addr, whois *apitype.WhoIsResponse) []byte {
+	b = append(b, proxyV2Signature...)
+	srcAddr, srcOK := addrPortFromNetAddr(src)
+	dstAddr, dstOK := addrPortFromNetAddr(dst)
+	if !srcOK || !dstOK || srcAddr.Addr().Is4() != dstAddr.Addr().Is4() {
+		// LOCAL command with unspecified family and no addresses.
+		return append(b, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	// PROXY command.
+	b = append(b, 0x21)
+	if srcAddr.Addr().Is4() {
+		b = append(b, 0x11) // TCP over IPv4
+	} else {
+		b = append(b, 0x21) // TCP over IPv6
+	}
+	lenPos := len(b)
+	b = append(b, 0, 0)
+	b = append(b, srcAddr.Addr().AsSlice()...)
+	b = append(b, dstAddr.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, srcAddr.Port())
+	b = binary.BigEndian.AppendUint16(b, dstAddr.Port())
+	if whois != nil {
+		if whois.UserProfile != nil {
+			b = appendProxyTLV(b, proxyTLVTailscaleUser, whois.UserProfile.LoginName)
+		}
+		if whois.Node != nil {
+			b = appendProxyTLV(b, proxyTLVTailscaleNode, strings.TrimSuffix(whois.Node.Name, "."))
+		}
+	}
+	binary.BigEndian.PutUint16(b[lenPos:], uint16(len(b)-lenPos-2))
+	return b
+}
+
+func appendProxyTLV(b []byte, typ byte, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func addrPortFromNetAddr(addr net.Addr) (netip.AddrPort, bool) {
+	if addr == nil {
+		return netip.AddrPort{}, false
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+}
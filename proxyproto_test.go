@@ -0,0 +1,136 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestAppendProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		want string
+	}{
+		{
+			name: "IPv4",
+			src:  &net.TCPAddr{IP: net.IPv4(100, 64, 0, 1), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.IPv4(100, 64, 0, 2), Port: 443},
+			want: "PROXY TCP4 100.64.0.1 100.64.0.2 56324 443\r\n",
+		},
+		{
+			name: "IPv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::1"), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::2"), Port: 443},
+			want: "PROXY TCP6 fd7a:115c:a1e0::1 fd7a:115c:a1e0::2 56324 443\r\n",
+		},
+		{
+			name: "Mixed",
+			src:  &net.TCPAddr{IP: net.IPv4(100, 64, 0, 1), Port: 56324},
+			dst:  &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::2"), Port: 443},
+			want: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name: "Pipe",
+			src:  pipeAddr{},
+			dst:  pipeAddr{},
+			want: "PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(appendProxyHeaderV1(nil, test.src, test.dst))
+			if got != test.want {
+				t.Errorf("appendProxyHeaderV1(nil, %v, %v) = %q; want %q", test.src, test.dst, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAppendProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(100, 64, 0, 1), Port: 0x1234}
+	dst := &net.TCPAddr{IP: net.IPv4(100, 64, 0, 2), Port: 443}
+	tests := []struct {
+		name  string
+		src   net.Addr
+		dst   net.Addr
+		whois *apitype.WhoIsResponse
+		want  []byte
+	}{
+		{
+			name: "IPv4",
+			src:  src,
+			dst:  dst,
+			want: []byte(proxyV2Signature +
+				"\x21\x11\x00\x0c" +
+				"\x64\x40\x00\x01" +
+				"\x64\x40\x00\x02" +
+				"\x12\x34\x01\xbb"),
+		},
+		{
+			name: "IPv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::1"), Port: 0x1234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::2"), Port: 443},
+			want: []byte(proxyV2Signature +
+				"\x21\x21\x00\x24" +
+				"\xfd\x7a\x11\x5c\xa1\xe0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xfd\x7a\x11\x5c\xa1\xe0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x12\x34\x01\xbb"),
+		},
+		{
+			name: "WhoIs",
+			src:  src,
+			dst:  dst,
+			whois: &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+			},
+			want: []byte(proxyV2Signature +
+				"\x21\x11\x00\x38" +
+				"\x64\x40\x00\x01" +
+				"\x64\x40\x00\x02" +
+				"\x12\x34\x01\xbb" +
+				"\xe0\x00\x11alice@example.com" +
+				"\xe1\x00\x15laptop.example.ts.net"),
+		},
+		{
+			name: "Unknown",
+			src:  pipeAddr{},
+			dst:  pipeAddr{},
+			want: []byte(proxyV2Signature + "\x20\x00\x00\x00"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := appendProxyHeaderV2(nil, test.src, test.dst, test.whois)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("appendProxyHeaderV2(nil, %v, %v, ...) (-want +got):\n%s", test.src, test.dst, diff)
+			}
+		})
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,141 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/log"
+)
+
+// clientHelloTimeout is the maximum amount of time
+// to wait for a client to send its TLS ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+// tlsRouter chooses a load balancer for a TLS connection
+// based on the server name the client requested.
+type tlsRouter struct {
+	// defaultRoute is used for connections that don't match any route.
+	// It may be nil.
+	defaultRoute *tcpLoadBalancer
+	// routes maps lowercase server names (or "*." wildcard patterns)
+	// to load balancers.
+	routes map[string]*tcpLoadBalancer
+}
+
+// route returns the load balancer for the given server name
+// or nil if there is none.
+// Exact matches take precedence over wildcards.
+func (r *tlsRouter) route(serverName string) *tcpLoadBalancer {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName != "" {
+		if tlb := r.routes[serverName]; tlb != nil {
+			return tlb
+		}
+		if _, parent, ok := strings.Cut(serverName, "."); ok {
+			if tlb := r.routes["*."+parent]; tlb != nil {
+				return tlb
+			}
+		}
+	}
+	return r.defaultRoute
+}
+
+// handleTLSConn reads the TLS ClientHello from clientConn
+// and forwards the connection (including the ClientHello)
+// to a backend chosen by the requested server name.
+// The TLS session is not terminated.
+func handleTLSConn(ctx context.Context, clientConn net.Conn, r *tlsRouter) {
+	serverName, peeked, err := peekClientHello(ctx, clientConn)
+	if err != nil {
+		log.Warnf(ctx, "Connection from %v on %v: %v", clientConn.RemoteAddr(), clientConn.LocalAddr(), err)
+		clientConn.Close()
+		return
+	}
+	tlb := r.route(serverName)
+	if tlb == nil {
+		log.Warnf(ctx, "Connection from %v on %v: no route for server name %q", clientConn.RemoteAddr(), clientConn.LocalAddr(), serverName)
+		clientConn.Close()
+		return
+	}
+	log.Debugf(ctx, "Routing connection from %v on %v for server name %q", clientConn.RemoteAddr(), clientConn.LocalAddr(), serverName)
+	handleTCPConn(ctx, &prefixConn{
+		Conn: clientConn,
+		r:    io.MultiReader(bytes.NewReader(peeked), clientConn),
+	}, tlb)
+}
+
+// errStopHandshake is returned from the GetConfigForClient callback
+// in peekClientHello to stop the handshake after reading the ClientHello.
+var errStopHandshake = errors.New("stop handshake")
+
+// peekClientHello reads the TLS ClientHello from conn.
+// It returns the server name that the client requested (which may be empty)
+// and the bytes it read from conn.
+func peekClientHello(ctx context.Context, conn net.Conn) (serverName string, peeked []byte, err error) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	rec := &recordingConn{Conn: conn}
+	var hello *tls.ClientHelloInfo
+	tlsConn := tls.Server(rec, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errStopHandshake
+		},
+	})
+	err = tlsConn.HandshakeContext(ctx)
+	if hello == nil {
+		return "", nil, fmt.Errorf("read TLS ClientHello: %w", err)
+	}
+	return hello.ServerName, rec.buf.Bytes(), nil
+}
+
+// recordingConn is a [net.Conn] that saves the bytes read from it
+// and discards writes, so that the client doesn't see any alerts.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// prefixConn is a [net.Conn] that reads from r instead of the connection.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
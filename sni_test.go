@@ -0,0 +1,138 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/log/testlog"
+)
+
+func TestTLSRouterRoute(t *testing.T) {
+	exact := new(tcpLoadBalancer)
+	wildcard := new(tcpLoadBalancer)
+	def := new(tcpLoadBalancer)
+	r := &tlsRouter{
+		defaultRoute: def,
+		routes: map[string]*tcpLoadBalancer{
+			"app.example.com": exact,
+			"*.example.com":   wildcard,
+		},
+	}
+	tests := []struct {
+		serverName string
+		want       *tcpLoadBalancer
+	}{
+		{"app.example.com", exact},
+		{"APP.Example.com.", exact},
+		{"other.example.com", wildcard},
+		{"a.b.example.com", def},
+		{"example.com", def},
+		{"", def},
+	}
+	for _, test := range tests {
+		if got := r.route(test.serverName); got != test.want {
+			t.Errorf("route(%q) = %p; want %p", test.serverName, got, test.want)
+		}
+	}
+
+	r.defaultRoute = nil
+	if got := r.route("example.org"); got != nil {
+		t.Errorf("route(%q) without default = %p; want <nil>", "example.org", got)
+	}
+}
+
+func TestHandleTLSConn(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+
+	// Each backend is a TLS server with its own certificate,
+	// so a successful handshake means the connection was passed through
+	// without being terminated.
+	newBackend := func(body string) (*httptest.Server, *tcpLoadBalancer) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(srv.Close)
+		addr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+		return srv, &tcpLoadBalancer{
+			lb: newLoadBalancer(fakeResolver{}, []*backend{
+				{addr: addr.Addr(), port: addr.Port()},
+			}),
+			connectTimeout: 10 * time.Second,
+		}
+	}
+	fooSrv, fooLB := newBackend("foo")
+	barSrv, barLB := newBackend("bar")
+	router := &tlsRouter{
+		routes: map[string]*tcpLoadBalancer{
+			"foo.example.com": fooLB,
+			"bar.example.com": barLB,
+		},
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	tests := []struct {
+		serverName string
+		srv        *httptest.Server
+		want       string
+	}{
+		{"foo.example.com", fooSrv, "foo"},
+		{"bar.example.com", barSrv, "bar"},
+	}
+	for _, test := range tests {
+		client := test.srv.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.ServerName = test.serverName
+		transport.DialTLSContext = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handleTLSConn(ctx, serverConn, router)
+			}()
+			return clientConn, nil
+		}
+		transport.ForceAttemptHTTP2 = false
+		client.Transport = transport
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+test.serverName+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("GET https://%s/: %v", test.serverName, err)
+			continue
+		}
+		var buf [16]byte
+		n, _ := resp.Body.Read(buf[:])
+		resp.Body.Close()
+		if got := string(buf[:n]); got != test.want {
+			t.Errorf("GET https://%s/ = %q; want %q", test.serverName, got, test.want)
+		}
+		transport.CloseIdleConnections()
+	}
+}
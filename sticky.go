@@ -0,0 +1,117 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+const defaultStickyCookieName = "tailscale-lb-backend"
+
+// minStickyKeySize is the minimum number of bytes
+// in a sticky-cookie-key-file.
+const minStickyKeySize = 16
+
+// stickyCookie identifies a backend address in an HTTP cookie
+// so that a client's requests can be sent to the same address.
+// The cookie's value is an HMAC of the address,
+// so clients can neither see nor forge which address they are using.
+type stickyCookie struct {
+	name   string
+	key    []byte
+	secure bool
+}
+
+// newStickyCookie returns a new stickyCookie that signs cookies with key.
+// If key is nil, a random key is used,
+// so cookies issued by one stickyCookie are not recognized by another.
+func newStickyCookie(name string, key []byte, secure bool) *stickyCookie {
+	if key == nil {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &stickyCookie{name: name, key: key, secure: secure}
+}
+
+func (sc *stickyCookie) sum(addr netip.AddrPort) []byte {
+	mac := hmac.New(sha256.New, sc.key)
+	addrBytes, _ := addr.MarshalBinary()
+	mac.Write(addrBytes)
+	return mac.Sum(nil)
+}
+
+// matcher returns a function that reports whether an address
+// is the one identified by the cookie in the request.
+// It returns nil if the request does not have a cookie.
+func (sc *stickyCookie) matcher(r *http.Request) func(netip.AddrPort) bool {
+	c, err := r.Cookie(sc.name)
+	if err != nil {
+		return nil
+	}
+	got, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	return func(addr netip.AddrPort) bool {
+		return hmac.Equal(got, sc.sum(addr))
+	}
+}
+
+// set adds a Set-Cookie header identifying addr to h.
+func (sc *stickyCookie) set(h http.Header, addr netip.AddrPort) {
+	c := &http.Cookie{
+		Name:     sc.name,
+		Value:    base64.RawURLEncoding.EncodeToString(sc.sum(addr)),
+		Path:     "/",
+		Secure:   sc.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	h.Add("Set-Cookie", c.String())
+}
+
+// strip removes the cookie from a request's Cookie headers
+// so that it is not forwarded to the backend.
+// Other cookies are passed through byte-for-byte.
+func (sc *stickyCookie) strip(h http.Header) {
+	values := h.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+	newValues := make([]string, 0, len(values))
+	for _, v := range values {
+		parts := strings.Split(v, ";")
+		parts = slices.DeleteFunc(parts, func(part string) bool {
+			name, _, _ := strings.Cut(part, "=")
+			return strings.TrimSpace(name) == sc.name
+		})
+		if v := strings.TrimLeft(strings.Join(parts, ";"), " "); v != "" {
+			newValues = append(newValues, v)
+		}
+	}
+	h.Del("Cookie")
+	if len(newValues) > 0 {
+		h["Cookie"] = newValues
+	}
+}
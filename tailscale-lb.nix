@@ -56,7 +56,7 @@ buildGoModule {
   subPackages = [ "." ];
 
   meta = {
-    description = "Basic load-balancer for forwarding Tailscale TCP traffic";
+    description = "Basic load-balancer for forwarding Tailscale TCP and UDP traffic";
     homepage = "https://github.com/zombiezen/tailscale-lb";
     license = lib.licenses.asl20;
     maintainers = [ lib.maintainers.zombiezen ];
@@ -0,0 +1,115 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"zombiezen.com/go/log"
+)
+
+type tcpLoadBalancer struct {
+	lb        *loadBalancer
+	tailscale *tailscale.LocalClient
+	// hashKey is the source of the key passed to the load balancer.
+	// It is empty if the load balancer does not use the hash algorithm.
+	hashKey hashKeySource
+	// retries is the number of additional backends to try
+	// if connecting to the first backend fails.
+	retries int
+	// connectTimeout is the maximum amount of time to spend
+	// picking and connecting to backends for a single connection.
+	// Zero means no timeout.
+	connectTimeout time.Duration
+	// proxyProtocol is the version of the PROXY protocol header
+	// to send to backends or proxyProtocolNone.
+	proxyProtocol int
+	// access is the list of policies that must all allow
+	// a client's Tailscale identity before it is connected to a backend.
+	access []*accessPolicy
+}
+
+// checkAccess reports whether the client identified by whois may connect.
+// Denials are logged.
+func (tlb *tcpLoadBalancer) checkAccess(ctx context.Context, clientConn net.Conn, whois *apitype.WhoIsResponse) bool {
+	remoteAddr := clientConn.RemoteAddr().String()
+	target := clientConn.LocalAddr().String()
+	if whois == nil {
+		logAccessDenied(ctx, remoteAddr, target, nil, errUnidentified)
+		return false
+	}
+	for _, p := range tlb.access {
+		if err := p.check(whois); err != nil {
+			logAccessDenied(ctx, remoteAddr, target, whois, err)
+			return false
+		}
+	}
+	return true
+}
+
+// dialBackend connects to a backend picked from the load balancer.
+// If connecting fails, dialBackend tries up to tlb.retries other backends
+// before giving up.
+// whois is only called if the load balancer needs the client's identity.
+// On success, the caller is responsible for releasing the returned address
+// back to the load balancer.
+func (tlb *tcpLoadBalancer) dialBackend(ctx context.Context, clientConn net.Conn, whois func() *apitype.WhoIsResponse) (net.Conn, netip.AddrPort, error) {
+	if tlb.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tlb.connectTimeout)
+		defer cancel()
+	}
+
+	opts := &pickOptions{exclude: make(map[netip.AddrPort]struct{})}
+	if tlb.hashKey != "" {
+		opts.hashKey = tlb.hashKey.key(clientConn.RemoteAddr().String(), whois)
+	}
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		backendAddr, err := tlb.lb.pickWithOptions(ctx, opts)
+		if err != nil {
+			if lastErr != nil {
+				return nil, netip.AddrPort{}, fmt.Errorf("%w (last error: %v)", err, lastErr)
+			}
+			return nil, netip.AddrPort{}, err
+		}
+		log.Debugf(ctx, "Picked backend %v for %v on %v", backendAddr, clientConn.RemoteAddr(), clientConn.LocalAddr())
+		backendConn, err := new(net.Dialer).DialContext(ctx, "tcp", backendAddr.String())
+		if err == nil {
+			tlb.lb.report(ctx, backendAddr, true)
+			return backendConn, backendAddr, nil
+		}
+		tlb.lb.release(ctx, backendAddr)
+		if ctx.Err() == nil {
+			// Only count the failure against the backend
+			// if it wasn't caused by our own deadline or shutdown.
+			tlb.lb.report(ctx, backendAddr, false)
+		}
+		if attempt >= tlb.retries || ctx.Err() != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		log.Infof(ctx, "Connect to backend %v for %v on %v failed (retrying): %v", backendAddr, clientConn.RemoteAddr(), clientConn.LocalAddr(), err)
+		opts.exclude[backendAddr] = struct{}{}
+		lastErr = err
+	}
+}
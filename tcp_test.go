@@ -0,0 +1,268 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"zombiezen.com/go/ini"
+	"zombiezen.com/go/log/testlog"
+)
+
+func TestTCPRetry(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	goodAddr := startEchoServer(t)
+	badAddr := closedPort(t)
+
+	tlb := &tcpLoadBalancer{
+		lb: newLoadBalancer(fakeResolver{}, []*backend{
+			{addr: badAddr.Addr(), port: badAddr.Port()},
+			{addr: goodAddr.Addr(), port: goodAddr.Port()},
+		}),
+		retries:        1,
+		connectTimeout: 10 * time.Second,
+	}
+	// Regardless of which backend is picked first,
+	// every connection should reach the echo server.
+	for i := 0; i < 4; i++ {
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleTCPConn(ctx, serverConn, tlb)
+		}()
+
+		const msg = "Hello, World!\n"
+		if _, err := io.WriteString(clientConn, msg); err != nil {
+			t.Fatalf("Connection #%d: %v", i+1, err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(clientConn, got); err != nil {
+			t.Fatalf("Connection #%d: %v", i+1, err)
+		}
+		if string(got) != msg {
+			t.Errorf("Connection #%d: got %q; want %q", i+1, got, msg)
+		}
+		clientConn.Close()
+		<-done
+	}
+}
+
+func TestTCPRetryExhausted(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	badAddr := closedPort(t)
+	tlb := &tcpLoadBalancer{
+		lb: newLoadBalancer(fakeResolver{}, []*backend{
+			{addr: badAddr.Addr(), port: badAddr.Port()},
+		}),
+		retries:        3,
+		connectTimeout: 10 * time.Second,
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	conn, addr, err := tlb.dialBackend(ctx, serverConn, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("tlb.dialBackend(...) = _, %v, <nil>; want error", addr)
+	}
+	t.Log("tlb.dialBackend(...) error:", err)
+}
+
+func TestTCPTLSTermination(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	backendAddr := startEchoServer(t)
+	tlb := &tcpLoadBalancer{
+		lb: newLoadBalancer(fakeResolver{}, []*backend{
+			{addr: backendAddr.Addr(), port: backendAddr.Port()},
+		}),
+		connectTimeout: 10 * time.Second,
+	}
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	defer certSrv.Close()
+
+	clientPipe, serverPipe := net.Pipe()
+	serverConn := tls.Server(serverPipe, &tls.Config{
+		Certificates: certSrv.TLS.Certificates,
+		NextProtos:   []string{"mqtt"},
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleTCPConn(ctx, serverConn, tlb)
+	}()
+	defer func() {
+		clientPipe.Close()
+		<-done
+	}()
+
+	clientConn := tls.Client(clientPipe, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    certSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		NextProtos: []string{"mqtt"},
+	})
+	if err := clientConn.HandshakeContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clientConn.ConnectionState().NegotiatedProtocol, "mqtt"; got != want {
+		t.Errorf("negotiated protocol = %q; want %q", got, want)
+	}
+	const msg = "Hello, World!\n"
+	if _, err := io.WriteString(clientConn, msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(clientConn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Errorf("got %q; want %q", got, msg)
+	}
+}
+
+// startEchoServer starts a TCP server on the loopback interface
+// that writes back anything it reads.
+func startEchoServer(tb testing.TB) netip.AddrPort {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return netip.MustParseAddrPort(l.Addr().String())
+}
+
+// closedPort returns a loopback address that is not accepting connections.
+func closedPort(tb testing.TB) netip.AddrPort {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := netip.MustParseAddrPort(l.Addr().String())
+	if err := l.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return addr
+}
+
+func TestTCPAccess(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	echoAddr := startEchoServer(t)
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+				Node: &tailcfg.Node{
+					Name: "ci.example.ts.net.",
+					Tags: []string{"tag:ci"},
+				},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+
+	tests := []struct {
+		name    string
+		input   string
+		allowed bool
+	}{
+		{name: "AllowTag", input: "[tcp 22]\nallow-tag = tag:ci\n", allowed: true},
+		{name: "AllowNode", input: "[tcp 22]\nallow-node = ci\n", allowed: true},
+		{name: "AllowUser", input: "[tcp 22]\nallow-user = alice@example.com\n", allowed: false},
+		{name: "AllowOtherTag", input: "[tcp 22]\nallow-tag = server\n", allowed: false},
+		{name: "Deny", input: "[tcp 22]\nallow-tag = ci\ndeny = node:ci\n", allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ini.Parse(strings.NewReader(test.input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := parseAccessPolicy(f, "tcp 22")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlb := &tcpLoadBalancer{
+				lb: newLoadBalancer(fakeResolver{}, []*backend{
+					{addr: echoAddr.Addr(), port: echoAddr.Port()},
+				}),
+				tailscale: &tailscale.LocalClient{
+					Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return net.Dial("tcp", tailscaleLocalAPIAddr)
+					},
+				},
+				access: []*accessPolicy{p},
+			}
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handleTCPConn(ctx, serverConn, tlb)
+			}()
+
+			if !test.allowed {
+				// Denied connections are closed without reading anything.
+				if n, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("Read() = %d, %v; want 0, EOF", n, err)
+				}
+				<-done
+				return
+			}
+			const msg = "Hello, World!\n"
+			if _, err := io.WriteString(clientConn, msg); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(clientConn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != msg {
+				t.Errorf("got %q; want %q", got, msg)
+			}
+			clientConn.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"zombiezen.com/go/log"
+)
+
+type udpLoadBalancer struct {
+	lb        *loadBalancer
+	tailscale *tailscale.LocalClient
+	// hashKey is the source of the key passed to the load balancer.
+	// It is empty if the load balancer does not use the hash algorithm.
+	hashKey hashKeySource
+	// idleTimeout is how long a flow can go without traffic
+	// in either direction before it is forgotten.
+	idleTimeout time.Duration
+	// maxFlows is the maximum number of flows a listener tracks at once.
+	// Datagrams from new client addresses are dropped while at the limit.
+	// If zero, then the number of flows is not limited.
+	maxFlows int
+}
+
+// maxDatagramSize is the size of the largest UDP payload.
+const maxDatagramSize = 65535
+
+// udpConnectTimeout is the maximum amount of time to spend
+// picking and connecting to a backend for a new flow.
+const udpConnectTimeout = 10 * time.Second
+
+// maxPendingDatagrams is the number of datagrams queued for a flow
+// while it connects to a backend.
+// Further datagrams are dropped until the flow is connected.
+const maxPendingDatagrams = 16
+
+// udpFlow is the state of datagrams from a single client address.
+type udpFlow struct {
+	clientAddr net.Addr
+	// lastActive is the time of the last datagram in either direction
+	// in Unix nanoseconds.
+	lastActive atomic.Int64
+
+	// The following fields are protected by the udpFlows mutex.
+
+	// backendAddr and backendConn are set once the flow is connected.
+	backendAddr netip.AddrPort
+	backendConn net.Conn
+	// pending is the list of datagrams received while connecting.
+	pending [][]byte
+}
+
+func (flow *udpFlow) touch() {
+	flow.lastActive.Store(time.Now().UnixNano())
+}
+
+// udpFlows is the set of flows for a listener keyed by client address.
+type udpFlows struct {
+	mu sync.Mutex
+	m  map[string]*udpFlow
+}
+
+// expire removes the flow and closes its backend connection
+// if it has been idle for at least idleTimeout.
+// It reports whether the flow was removed.
+func (flows *udpFlows) expire(key string, flow *udpFlow, idleTimeout time.Duration) bool {
+	flows.mu.Lock()
+	defer flows.mu.Unlock()
+	if time.Since(time.Unix(0, flow.lastActive.Load())) < idleTimeout {
+		return false
+	}
+	flows.removeLocked(key, flow)
+	return true
+}
+
+// remove removes the flow and closes its backend connection.
+func (flows *udpFlows) remove(key string, flow *udpFlow) {
+	flows.mu.Lock()
+	defer flows.mu.Unlock()
+	flows.removeLocked(key, flow)
+}
+
+func (flows *udpFlows) removeLocked(key string, flow *udpFlow) {
+	if flows.m[key] == flow {
+		delete(flows.m, key)
+	}
+	if flow.backendConn != nil {
+		flow.backendConn.Close()
+	}
+}
+
+// serveUDP relays datagrams between clients sending to conn and backends
+// picked from the load balancer until ctx is canceled or conn is closed.
+// Each client address is assigned a backend when its first datagram arrives.
+// Backends are connected to in the background
+// so that a slow connection does not hold up other flows.
+// serveUDP closes conn before returning.
+func serveUDP(ctx context.Context, conn net.PacketConn, ulb *udpLoadBalancer) {
+	var closeOnce sync.Once
+	closeConn := func() {
+		closeOnce.Do(func() {
+			if err := conn.Close(); err != nil {
+				log.Errorf(ctx, "Closing UDP listener: %v", err)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	flows := &udpFlows{m: make(map[string]*udpFlow)}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		closeConn()
+		flows.mu.Lock()
+		defer flows.mu.Unlock()
+		for _, flow := range flows.m {
+			if flow.backendConn != nil {
+				flow.backendConn.Close()
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		closeConn()
+		wg.Wait()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Debugf(ctx, "Read on %v returned error (stopping listener): %v", conn.LocalAddr(), err)
+			return
+		}
+		key := clientAddr.String()
+		flows.mu.Lock()
+		if ctx.Err() != nil {
+			flows.mu.Unlock()
+			return
+		}
+		flow := flows.m[key]
+		if flow == nil && ulb.maxFlows > 0 && len(flows.m) >= ulb.maxFlows {
+			flows.mu.Unlock()
+			log.Debugf(ctx, "Dropping datagram from %v on %v: too many flows (%d)", clientAddr, conn.LocalAddr(), ulb.maxFlows)
+			continue
+		}
+		if flow == nil {
+			flow = &udpFlow{clientAddr: clientAddr}
+			flows.m[key] = flow
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ulb.runFlow(ctx, conn, flows, key, flow)
+			}()
+		}
+		// Touch the flow while holding the lock
+		// so that it can't expire before the datagram is written.
+		flow.touch()
+		backendConn := flow.backendConn
+		if backendConn == nil {
+			if len(flow.pending) < maxPendingDatagrams {
+				flow.pending = append(flow.pending, slices.Clone(buf[:n]))
+			} else {
+				log.Debugf(ctx, "Dropping datagram from %v on %v while connecting to backend", clientAddr, conn.LocalAddr())
+			}
+			flows.mu.Unlock()
+			continue
+		}
+		flows.mu.Unlock()
+		if _, err := backendConn.Write(buf[:n]); err != nil {
+			log.Warnf(ctx, "Forward datagram from %v on %v to %v: %v", clientAddr, conn.LocalAddr(), flow.backendAddr, err)
+		}
+	}
+}
+
+// runFlow connects a new flow to a backend,
+// forwards any datagrams that arrived in the meantime,
+// and relays replies until the flow expires.
+func (ulb *udpLoadBalancer) runFlow(ctx context.Context, conn net.PacketConn, flows *udpFlows, key string, flow *udpFlow) {
+	dialCtx, cancel := context.WithTimeout(ctx, udpConnectTimeout)
+	backendConn, backendAddr, err := ulb.dialBackend(dialCtx, flow.clientAddr)
+	cancel()
+	if err != nil {
+		log.Warnf(ctx, "Connect to backend for %v on %v: %v", flow.clientAddr, conn.LocalAddr(), err)
+		flows.remove(key, flow)
+		return
+	}
+	defer ulb.lb.release(ctx, backendAddr)
+	log.Debugf(ctx, "New UDP flow from %v on %v to %v", flow.clientAddr, conn.LocalAddr(), backendAddr)
+
+	flows.mu.Lock()
+	if ctx.Err() != nil {
+		flows.mu.Unlock()
+		backendConn.Close()
+		return
+	}
+	flow.backendAddr = backendAddr
+	flow.backendConn = backendConn
+	for _, msg := range flow.pending {
+		if _, err := backendConn.Write(msg); err != nil {
+			log.Warnf(ctx, "Forward datagram from %v on %v to %v: %v", flow.clientAddr, conn.LocalAddr(), backendAddr, err)
+		}
+	}
+	flow.pending = nil
+	flows.mu.Unlock()
+
+	ulb.relayReplies(ctx, conn, flows, key, flow)
+	flows.remove(key, flow)
+}
+
+// dialBackend picks a backend for a new flow and connects to it.
+// The caller is responsible for closing the returned connection
+// and releasing its address back to the load balancer.
+func (ulb *udpLoadBalancer) dialBackend(ctx context.Context, clientAddr net.Addr) (net.Conn, netip.AddrPort, error) {
+	opts := new(pickOptions)
+	if ulb.hashKey != "" {
+		opts.hashKey = ulb.hashKey.key(clientAddr.String(), func() *apitype.WhoIsResponse {
+			whois, err := ulb.tailscale.WhoIs(ctx, clientAddr.String())
+			if err != nil {
+				log.Warnf(ctx, "Tailscale whois for %v: %v", clientAddr, err)
+				return nil
+			}
+			return whois
+		})
+	}
+	backendAddr, err := ulb.lb.pickWithOptions(ctx, opts)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	backendConn, err := new(net.Dialer).DialContext(ctx, "udp", backendAddr.String())
+	if err != nil {
+		ulb.lb.release(ctx, backendAddr)
+		if ctx.Err() == nil {
+			ulb.lb.report(ctx, backendAddr, false)
+		}
+		return nil, netip.AddrPort{}, err
+	}
+	return backendConn, backendAddr, nil
+}
+
+// relayReplies sends datagrams from the flow's backend to its client
+// until the flow has been idle for ulb.idleTimeout
+// or the backend connection is closed.
+func (ulb *udpLoadBalancer) relayReplies(ctx context.Context, conn net.PacketConn, flows *udpFlows, key string, flow *udpFlow) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := time.Unix(0, flow.lastActive.Load()).Add(ulb.idleTimeout)
+		flow.backendConn.SetReadDeadline(deadline)
+		n, err := flow.backendConn.Read(buf)
+		switch {
+		case err == nil:
+			ulb.lb.report(ctx, flow.backendAddr, true)
+			flow.touch()
+			if _, err := conn.WriteTo(buf[:n], flow.clientAddr); err != nil {
+				log.Warnf(ctx, "Reply to %v on %v from %v: %v", flow.clientAddr, conn.LocalAddr(), flow.backendAddr, err)
+			}
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if flows.expire(key, flow, ulb.idleTimeout) {
+				log.Debugf(ctx, "UDP flow from %v on %v to %v idle", flow.clientAddr, conn.LocalAddr(), flow.backendAddr)
+				return
+			}
+			// The client sent a datagram since we set the deadline.
+		case errors.Is(err, syscall.ECONNREFUSED):
+			// The backend sent an ICMP port unreachable message.
+			log.Debugf(ctx, "UDP flow from %v on %v to %v: %v", flow.clientAddr, conn.LocalAddr(), flow.backendAddr, err)
+			ulb.lb.report(ctx, flow.backendAddr, false)
+		default:
+			if ctx.Err() == nil {
+				log.Warnf(ctx, "UDP flow from %v on %v to %v: %v", flow.clientAddr, conn.LocalAddr(), flow.backendAddr, err)
+			}
+			return
+		}
+	}
+}
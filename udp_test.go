@@ -0,0 +1,292 @@
+// Copyright 2026 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"zombiezen.com/go/log/testlog"
+)
+
+func TestUDP(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	backendAddr := startUDPEchoServer(t)
+	lb := newLoadBalancer(fakeResolver{}, []*backend{{
+		addr: backendAddr.Addr(),
+		port: backendAddr.Port(),
+	}})
+	ulb := &udpLoadBalancer{
+		lb:          lb,
+		idleTimeout: 200 * time.Millisecond,
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveUDP(ctx, conn, ulb)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, msg := range []string{"Hello", "World"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 100)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != msg {
+			t.Errorf("reply = %q; want %q", got, msg)
+		}
+	}
+
+	// Once the flow is idle, it should release the backend.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		lb.mu.Lock()
+		active := lb.active[backendAddr]
+		lb.mu.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v still has %d flows after idle timeout", backendAddr, active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPSlowConnect(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slowClient, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowClient.Close()
+	fastClient, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fastClient.Close()
+
+	// Hold up the Tailscale whois for the slow client
+	// until the fast client has been served.
+	unblock := make(chan struct{})
+	tailscaleLocalAPISrv := httptest.NewServer(fakeWhoIsHandler(
+		func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			if remoteAddr == slowClient.LocalAddr().String() {
+				select {
+				case <-unblock:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			return &apitype.WhoIsResponse{
+				Node: &tailcfg.Node{StableID: tailcfg.StableNodeID(remoteAddr)},
+			}, nil
+		},
+	))
+	defer tailscaleLocalAPISrv.Close()
+	defer close(unblock)
+	tailscaleLocalAPIAddr := tailscaleLocalAPISrv.Listener.Addr().String()
+
+	backendAddr := startUDPEchoServer(t)
+	lb := newLoadBalancer(fakeResolver{}, []*backend{{
+		addr: backendAddr.Addr(),
+		port: backendAddr.Port(),
+	}})
+	lb.algorithm = hashing{}
+	ulb := &udpLoadBalancer{
+		lb: lb,
+		tailscale: &tailscale.LocalClient{
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", tailscaleLocalAPIAddr)
+			},
+		},
+		hashKey:     hashKeyNode,
+		idleTimeout: time.Minute,
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveUDP(ctx, conn, ulb)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, msg := range []string{"first", "second"} {
+		if _, err := slowClient.WriteTo([]byte(msg), conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fastClient.WriteTo([]byte("fast"), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	fastClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := fastClient.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("While slow client is connecting:", err)
+	}
+	if got, want := string(buf[:n]), "fast"; got != want {
+		t.Errorf("fast client reply = %q; want %q", got, want)
+	}
+
+	// Once the slow client's flow connects,
+	// the datagrams it queued should be forwarded in order.
+	unblock <- struct{}{}
+	slowClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"first", "second"} {
+		n, _, err := slowClient.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("slow client reply = %q; want %q", got, want)
+		}
+	}
+}
+
+func TestUDPMaxFlows(t *testing.T) {
+	ctx := testlog.WithTB(context.Background(), t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	backendAddr := startUDPEchoServer(t)
+	ulb := &udpLoadBalancer{
+		lb: newLoadBalancer(fakeResolver{}, []*backend{{
+			addr: backendAddr.Addr(),
+			port: backendAddr.Port(),
+		}}),
+		idleTimeout: time.Minute,
+		maxFlows:    1,
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveUDP(ctx, conn, ulb)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client1, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+	client2, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	buf := make([]byte, 100)
+	if _, err := client1.Write([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	client1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client1.Read(buf); err != nil {
+		t.Fatal("First client:", err)
+	}
+
+	// The listener is at its limit, so the second client's datagram
+	// should be dropped.
+	if _, err := client2.Write([]byte("World")); err != nil {
+		t.Fatal(err)
+	}
+	client2.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := client2.Read(buf); err == nil {
+		t.Errorf("second client got reply %q; want no reply", buf[:n])
+	} else if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Second client:", err)
+	}
+
+	// The existing flow should still be served.
+	if _, err := client1.Write([]byte("Again")); err != nil {
+		t.Fatal(err)
+	}
+	client1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client1.Read(buf)
+	if err != nil {
+		t.Fatal("First client:", err)
+	}
+	if got, want := string(buf[:n]), "Again"; got != want {
+		t.Errorf("reply = %q; want %q", got, want)
+	}
+}
+
+// startUDPEchoServer starts a UDP server on the loopback interface
+// that replies to every datagram with the same payload.
+func startUDPEchoServer(tb testing.TB) netip.AddrPort {
+	tb.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return netip.MustParseAddrPort(conn.LocalAddr().String())
+}